@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/kevinburke/rest/v2"
+	"github.com/kevinburke/rest/v2/resterror"
+)
+
+// Errors returned by an Authenticator for bad credentials.
+var (
+	ErrUnknownUser       = errors.New("handlers: unknown user")
+	ErrIncorrectPassword = errors.New("handlers: incorrect password")
+)
+
+// Authentication methods recorded in a Principal.
+const (
+	AuthMethodBasic  = "basic"
+	AuthMethodBearer = "bearer"
+	AuthMethodAPIKey = "api_key"
+)
+
+// A Principal is an authenticated user.
+type Principal struct {
+	// Username identifies the user.
+	Username string
+	// AuthMethod is the way the user authenticated, like AuthMethodBasic.
+	AuthMethod string
+	// Roles lists the roles granted to the user, if the authentication
+	// method provides them.
+	Roles []string
+}
+
+// HasRole reports whether p was granted role.
+func (p *Principal) HasRole(role string) bool {
+	return slices.Contains(p.Roles, role)
+}
+
+// SetUser stores p on the request context, where it can be retrieved with
+// GetUser, and returns the modified HTTP request. The Log handler logs the
+// user's name and authentication method. Auth middlewares call SetUser after
+// authenticating a request.
+func SetUser(r *http.Request, p *Principal) *http.Request {
+	if holder, ok := r.Context().Value(extraLog).(*logHolder); ok {
+		holder.mu.Lock()
+		holder.user = p
+		holder.mu.Unlock()
+	}
+	return r.WithContext(context.WithValue(r.Context(), principal, p))
+}
+
+// GetUser returns the Principal authenticated for this request, or false if
+// no auth middleware authenticated it.
+func GetUser(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principal).(*Principal)
+	return p, ok
+}
+
+// An Authenticator checks a username and password. Authenticate should return
+// nil if the password is correct, ErrUnknownUser if there is no such user, and
+// ErrIncorrectPassword if the password is wrong. Any other error is treated as
+// a server error.
+//
+// Implementations must take as long to return ErrUnknownUser as
+// ErrIncorrectPassword, for example by checking the password against a dummy
+// hash with the same type and cost as the real ones, so that response times
+// don't reveal which users exist.
+type Authenticator interface {
+	Authenticate(user, password string) error
+}
+
+// The AuthenticatorFunc type is an adapter to allow the use of ordinary
+// functions as Authenticators.
+type AuthenticatorFunc func(user, password string) error
+
+// Authenticate calls f(user, password).
+func (f AuthenticatorFunc) Authenticate(user, password string) error {
+	return f(user, password)
+}
+
+// A RoleProvider reports the roles granted to a user. If the Authenticator
+// passed to BasicAuthWith implements RoleProvider, the roles are recorded in
+// the request's Principal.
+type RoleProvider interface {
+	Roles(user string) []string
+}
+
+// StaticUsers returns an Authenticator that checks passwords against the
+// plaintext passwords in users, in constant time. Prefer NewHtpasswdFile, which
+// stores hashed passwords.
+func StaticUsers(users map[string]string) Authenticator {
+	return AuthenticatorFunc(func(user, password string) error {
+		// Unknown users are compared against the empty password, so they
+		// take as long to reject as wrong passwords.
+		serverPass, ok := users[user]
+		match := comparePasswords(password, serverPass)
+		if !ok {
+			return ErrUnknownUser
+		}
+		if !match {
+			return ErrIncorrectPassword
+		}
+		return nil
+	})
+}
+
+// comparePasswords reports whether a and b are equal, in a time that doesn't
+// depend on either. Tests replace it to see which passwords are compared.
+var comparePasswords = func(a, b string) bool {
+	ha, hb := sha256.Sum256([]byte(a)), sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
+// BasicAuthWith protects all requests to the given handler, unless the request
+// has basic auth with a username and password accepted by auth. Requests
+// without credentials get a 401 response asking for credentials for realm, and
+// requests with bad credentials get a 403 response. The authenticated user is
+// available to h via GetUser.
+func BasicAuthWith(h http.Handler, realm string, auth Authenticator) http.Handler {
+	return BasicAuthWithOptions(h, BasicAuthOptions{Realm: realm, Authenticator: auth})
+}
+
+// BasicAuthOptions configures BasicAuthWithOptions.
+type BasicAuthOptions struct {
+	// Realm is sent in the WWW-Authenticate header of 401 responses.
+	Realm string
+
+	// Authenticator checks usernames and passwords.
+	Authenticator Authenticator
+
+	// UniformErrors sends the same error for unknown users and incorrect
+	// passwords, so clients can't tell which usernames exist.
+	UniformErrors bool
+
+	// Limiter, if set, locks out clients and usernames with too many failed
+	// attempts.
+	Limiter *AuthLimiter
+}
+
+// BasicAuthWithOptions is like BasicAuthWith, with options for hiding whether
+// a user exists and limiting password guessing. Requests from a client
+// address or for a username that are locked out by opts.Limiter get a 429
+// response with a Retry-After header, without checking the password.
+func BasicAuthWithOptions(h http.Handler, opts BasicAuthOptions) http.Handler {
+	auth := opts.Authenticator
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user == "" {
+			rest.Unauthorized(w, r, opts.Realm)
+			return
+		}
+		var ip string
+		if opts.Limiter != nil {
+			ip = clientAddr(r)
+			if wait := opts.Limiter.reserve(ip, user); wait > 0 {
+				tooManyAttempts(w, r, wait)
+				return
+			}
+		}
+		err := auth.Authenticate(user, pass)
+		if opts.Limiter != nil {
+			opts.Limiter.release(ip, user, err)
+		}
+		switch {
+		case err == nil:
+			p := &Principal{Username: user, AuthMethod: AuthMethodBasic}
+			if rp, ok := auth.(RoleProvider); ok {
+				p.Roles = rp.Roles(user)
+			}
+			h.ServeHTTP(w, SetUser(r, p))
+		case errors.Is(err, ErrUnknownUser), errors.Is(err, ErrIncorrectPassword) && opts.UniformErrors:
+			rest.Forbidden(w, r, &resterror.Error{
+				Title: "Username or password are invalid. Please double check your credentials",
+				ID:    "forbidden",
+			})
+		case errors.Is(err, ErrIncorrectPassword):
+			rest.Forbidden(w, r, &resterror.Error{
+				Title:    fmt.Sprintf("Incorrect password for user %s", user),
+				ID:       "incorrect_password",
+				Instance: r.URL.Path,
+			})
+		default:
+			rest.ServerError(w, r, err)
+		}
+	})
+}
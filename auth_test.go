@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBasicAuthWith(t *testing.T) {
+	t.Parallel()
+	auth := AuthenticatorFunc(func(user, password string) error {
+		switch {
+		case user == "broken":
+			return errors.New("database is down")
+		case user != "bob":
+			return ErrUnknownUser
+		case password != "secret":
+			return ErrIncorrectPassword
+		}
+		return nil
+	})
+	h := BasicAuthWith(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}), "admin", auth)
+	tests := []struct {
+		user, password string
+		code           int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"bob", "secret", http.StatusNoContent},
+		{"bob", "wrong", http.StatusForbidden},
+		{"eve", "secret", http.StatusForbidden},
+		{"broken", "secret", http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, tt.password)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%s/%s: got code %d, want %d", tt.user, tt.password, w.Code, tt.code)
+		}
+	}
+}
+
+func TestBasicAuthStaticUsers(t *testing.T) {
+	t.Parallel()
+	h := BasicAuth(http.NotFoundHandler(), "admin", map[string]string{"bob": "secret"})
+	req := httptest.NewRequest("GET", "/", nil)
+	req.SetBasicAuth("bob", "wrong")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got code %d, want 403", w.Code)
+	}
+	req.SetBasicAuth("bob", "secret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got code %d, want 404 from the wrapped handler", w.Code)
+	}
+}
+
+type roleUsers map[string]string
+
+func (u roleUsers) Authenticate(user, password string) error {
+	return StaticUsers(u).Authenticate(user, password)
+}
+
+func (u roleUsers) Roles(user string) []string {
+	return []string{"admin"}
+}
+
+func TestBasicAuthPrincipal(t *testing.T) {
+	t.Parallel()
+	var got *Principal
+	h := BasicAuthWith(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ok bool
+		got, ok = GetUser(r.Context())
+		if !ok {
+			t.Error("no user on request context")
+		}
+	}), "admin", roleUsers{"bob": "secret"})
+	req := httptest.NewRequest("GET", "/", nil)
+	req.SetBasicAuth("bob", "secret")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if got == nil || got.Username != "bob" || got.AuthMethod != AuthMethodBasic {
+		t.Fatalf("got principal %+v", got)
+	}
+	if !got.HasRole("admin") || got.HasRole("root") {
+		t.Errorf("got roles %q", got.Roles)
+	}
+	if _, ok := GetUser(httptest.NewRequest("GET", "/", nil).Context()); ok {
+		t.Error("expected no user without an auth middleware")
+	}
+}
@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kevinburke/rest/v2/resterror"
+)
+
+// Defaults for an AuthLimiter.
+const (
+	DefaultAuthMaxFailures = 5
+	DefaultAuthLockout     = time.Minute
+	DefaultAuthMaxLockout  = time.Hour
+)
+
+// authBusyRetry is how long clients are asked to wait when they have enough
+// login attempts in progress to be locked out if they all fail.
+const authBusyRetry = time.Second
+
+// An AuthLimiter counts failed login attempts per client address and per
+// username, and locks them out after too many failures. Every lockout of the
+// same address or username lasts twice as long as the previous one, up to
+// MaxLockout. A successful login resets the count for the username, and
+// counts are forgotten once there have been no failures or lockouts for
+// MaxLockout. Attempts that are still being checked count as failures, so
+// concurrent requests can't make more guesses than sequential ones.
+//
+// Locking out usernames stops attackers that spread their guesses over many
+// addresses, but lets anyone lock a user out by guessing wrong passwords for
+// them.
+//
+// The zero value is an AuthLimiter with the default settings. Set any options
+// before using it.
+type AuthLimiter struct {
+	// MaxFailures is the number of failures that triggers a lockout. If
+	// zero, DefaultAuthMaxFailures is used.
+	MaxFailures int
+
+	// Lockout is the length of the first lockout. If zero,
+	// DefaultAuthLockout is used.
+	Lockout time.Duration
+
+	// MaxLockout is the longest lockout. If zero, DefaultAuthMaxLockout is
+	// used.
+	MaxLockout time.Duration
+
+	// now returns the current time; tests replace it.
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[authLimitKey]*authLimitEntry
+	sweepAt int
+}
+
+type authLimitKey struct {
+	kind  string // "ip" or "user"
+	value string
+}
+
+type authLimitEntry struct {
+	failures    int
+	lockouts    int
+	lockedUntil time.Time
+	lastFailure time.Time
+	inflight    int // attempts reserved but not yet released
+}
+
+// idle returns how long it has been since the last failure or the end of the
+// last lockout, whichever is later.
+func (e *authLimitEntry) idle(now time.Time) time.Duration {
+	if e.lockedUntil.After(e.lastFailure) {
+		return now.Sub(e.lockedUntil)
+	}
+	return now.Sub(e.lastFailure)
+}
+
+func (l *AuthLimiter) settings() (maxFailures int, lockout, maxLockout time.Duration) {
+	maxFailures, lockout, maxLockout = l.MaxFailures, l.Lockout, l.MaxLockout
+	if maxFailures <= 0 {
+		maxFailures = DefaultAuthMaxFailures
+	}
+	if lockout <= 0 {
+		lockout = DefaultAuthLockout
+	}
+	if maxLockout <= 0 {
+		maxLockout = DefaultAuthMaxLockout
+	}
+	return maxFailures, lockout, max(lockout, maxLockout)
+}
+
+func (l *AuthLimiter) time() time.Time {
+	if l.now != nil {
+		return l.now()
+	}
+	return time.Now()
+}
+
+// authLimitKeys returns the entries that count attempts from ip for user.
+func authLimitKeys(ip, user string) []authLimitKey {
+	keys := make([]authLimitKey, 0, 2)
+	for _, key := range []authLimitKey{{"ip", ip}, {"user", user}} {
+		if key.value != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// locked returns how long ip or user are still locked out for, or zero if
+// neither is. l.mu must be held.
+func (l *AuthLimiter) locked(now time.Time, ip, user string) time.Duration {
+	var wait time.Duration
+	for _, key := range authLimitKeys(ip, user) {
+		if e, ok := l.entries[key]; ok && now.Before(e.lockedUntil) {
+			wait = max(wait, e.lockedUntil.Sub(now))
+		}
+	}
+	return wait
+}
+
+// reserve starts a login attempt from ip for user. It returns how long the
+// client should wait before trying again if ip or user are locked out, or
+// already have enough attempts in progress to be locked out if they all fail.
+// Otherwise it returns zero, and the caller must pass the result of the
+// attempt to release.
+func (l *AuthLimiter) reserve(ip, user string) time.Duration {
+	maxFailures, _, maxLockout := l.settings()
+	now := l.time()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if wait := l.locked(now, ip, user); wait > 0 {
+		return wait
+	}
+	l.sweep(now, maxLockout)
+	keys := authLimitKeys(ip, user)
+	for _, key := range keys {
+		if e := l.entry(key, now, maxLockout); e.failures+e.inflight >= maxFailures {
+			return authBusyRetry
+		}
+	}
+	for _, key := range keys {
+		l.entries[key].inflight++
+	}
+	return 0
+}
+
+// release records the result of an attempt started with reserve. err is the
+// error returned by the Authenticator; errors other than ErrUnknownUser and
+// ErrIncorrectPassword don't count as failures.
+func (l *AuthLimiter) release(ip, user string, err error) {
+	now := l.time()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range authLimitKeys(ip, user) {
+		if e, ok := l.entries[key]; ok {
+			e.inflight--
+		}
+	}
+	switch {
+	case err == nil:
+		l.succeeded(user)
+	case errors.Is(err, ErrUnknownUser), errors.Is(err, ErrIncorrectPassword):
+		l.failed(now, ip, user)
+	}
+}
+
+// entry returns the entry for key, creating it if needed, and forgetting old
+// failures and lockouts if it has been idle for longer than maxLockout.
+func (l *AuthLimiter) entry(key authLimitKey, now time.Time, maxLockout time.Duration) *authLimitEntry {
+	if l.entries == nil {
+		l.entries = make(map[authLimitKey]*authLimitEntry)
+	}
+	e, ok := l.entries[key]
+	if !ok {
+		e = &authLimitEntry{}
+		l.entries[key] = e
+	} else if e.idle(now) > maxLockout {
+		*e = authLimitEntry{inflight: e.inflight}
+	}
+	return e
+}
+
+// failed records a failed attempt from ip for user. l.mu must be held.
+func (l *AuthLimiter) failed(now time.Time, ip, user string) {
+	maxFailures, lockout, maxLockout := l.settings()
+	l.sweep(now, maxLockout)
+	for _, key := range authLimitKeys(ip, user) {
+		e := l.entry(key, now, maxLockout)
+		e.failures++
+		e.lastFailure = now
+		if e.failures < maxFailures {
+			continue
+		}
+		d := lockout
+		for i := 0; i < e.lockouts && d < maxLockout; i++ {
+			d *= 2
+		}
+		d = min(d, maxLockout)
+		e.lockouts++
+		e.failures = 0
+		e.lockedUntil = now.Add(d)
+		Logger.Warn("locked out after failed login attempts", "kind", key.kind,
+			key.kind, key.value, "failures", maxFailures, "lockout", d.String())
+	}
+}
+
+// succeeded records a successful login for user. l.mu must be held.
+func (l *AuthLimiter) succeeded(user string) {
+	key := authLimitKey{"user", user}
+	if e, ok := l.entries[key]; ok && e.inflight > 0 {
+		// Keep counting the attempts still in progress.
+		*e = authLimitEntry{inflight: e.inflight}
+		return
+	}
+	delete(l.entries, key)
+}
+
+// sweep drops entries with no recent failures, once the map has grown enough
+// since the last sweep.
+func (l *AuthLimiter) sweep(now time.Time, maxLockout time.Duration) {
+	if len(l.entries) < l.sweepAt {
+		return
+	}
+	for key, e := range l.entries {
+		if e.inflight == 0 && e.idle(now) > maxLockout {
+			delete(l.entries, key)
+		}
+	}
+	l.sweepAt = max(1024, 2*len(l.entries))
+}
+
+// clientAddr returns the client IP address for r, as determined by RealIP or
+// ProxyHeaders, or the address of the peer. Unlike getRemoteIP, it never
+// trusts proxy headers on its own, since clients can spoof them to dodge
+// rate limits.
+func clientAddr(r *http.Request) string {
+	if ip, ok := GetRealIP(r.Context()); ok {
+		return ip.String()
+	}
+	if holder, ok := r.Context().Value(extraLog).(*logHolder); ok {
+		holder.mu.Lock()
+		addr := holder.remoteAddr
+		holder.mu.Unlock()
+		if addr != "" {
+			return addr
+		}
+	}
+	if addr, ok := parseHostAddr(r.RemoteAddr); ok {
+		return addr.Unmap().String()
+	}
+	return r.RemoteAddr
+}
+
+func tooManyAttempts(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	secs := int64((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+	writeError(w, r, http.StatusTooManyRequests, &resterror.Error{
+		Title: "Too many failed login attempts. Please try again in " + strconv.FormatInt(secs, 10) + " seconds",
+		ID:    "too_many_requests",
+	})
+}
@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+// errAuthDown is an Authenticator error that doesn't count as a failed login.
+var errAuthDown = errors.New("authenticator is down")
+
+// attempt makes a login attempt from ip for user that ends with err. It
+// returns how long the client must wait if the attempt isn't allowed, or zero
+// if it is.
+func attempt(l *AuthLimiter, ip, user string, err error) time.Duration {
+	if wait := l.reserve(ip, user); wait > 0 {
+		return wait
+	}
+	l.release(ip, user, err)
+	return 0
+}
+
+func TestAuthLimiterBackoff(t *testing.T) {
+	t.Parallel()
+	clock := &fakeClock{time.Unix(1_700_000_000, 0)}
+	l := &AuthLimiter{MaxFailures: 3, Lockout: time.Minute, MaxLockout: 3 * time.Minute, now: clock.now}
+	for i := range 3 {
+		if wait := attempt(l, "192.0.2.1", "bob", ErrIncorrectPassword); wait != 0 {
+			t.Fatalf("attempt %d: locked out early for %v", i, wait)
+		}
+	}
+	if wait := attempt(l, "192.0.2.1", "alice", errAuthDown); wait != time.Minute {
+		t.Errorf("expected address to be locked for 1m, got %v", wait)
+	}
+	if wait := attempt(l, "198.51.100.7", "bob", errAuthDown); wait != time.Minute {
+		t.Errorf("expected username to be locked for 1m, got %v", wait)
+	}
+	if wait := attempt(l, "198.51.100.7", "alice", errAuthDown); wait != 0 {
+		t.Errorf("expected other clients to be unaffected, got %v", wait)
+	}
+
+	// Each lockout is twice as long as the last, up to MaxLockout.
+	for _, want := range []time.Duration{2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		clock.t = clock.t.Add(time.Minute + attempt(l, "192.0.2.1", "", errAuthDown))
+		for range 3 {
+			attempt(l, "192.0.2.1", "bob", ErrIncorrectPassword)
+		}
+		if wait := attempt(l, "192.0.2.1", "", errAuthDown); wait != want {
+			t.Errorf("got lockout %v, want %v", wait, want)
+		}
+	}
+
+	// A success resets the username, but not the address.
+	clock.t = clock.t.Add(time.Hour)
+	attempt(l, "192.0.2.1", "bob", ErrIncorrectPassword)
+	attempt(l, "192.0.2.1", "bob", ErrIncorrectPassword)
+	attempt(l, "192.0.2.1", "bob", nil)
+	attempt(l, "192.0.2.2", "bob", ErrIncorrectPassword)
+	if wait := attempt(l, "192.0.2.2", "bob", errAuthDown); wait != 0 {
+		t.Errorf("expected success to reset the username count, got lockout %v", wait)
+	}
+	attempt(l, "192.0.2.1", "carol", ErrIncorrectPassword)
+	if wait := attempt(l, "192.0.2.1", "", errAuthDown); wait == 0 {
+		t.Error("expected address count to survive a success")
+	}
+}
+
+func TestAuthLimiterInFlight(t *testing.T) {
+	t.Parallel()
+	clock := &fakeClock{time.Unix(1_700_000_000, 0)}
+	l := &AuthLimiter{MaxFailures: 2, now: clock.now}
+	for range 2 {
+		if wait := l.reserve("192.0.2.1", "bob"); wait != 0 {
+			t.Fatalf("got wait %v, want the attempt to go ahead", wait)
+		}
+	}
+	if wait := l.reserve("198.51.100.7", "bob"); wait != authBusyRetry {
+		t.Errorf("got wait %v with two attempts in progress, want %v", wait, authBusyRetry)
+	}
+	// A success doesn't forget the attempt still in progress.
+	l.release("192.0.2.1", "bob", nil)
+	l.release("192.0.2.1", "bob", ErrIncorrectPassword)
+	if wait := attempt(l, "198.51.100.7", "bob", ErrIncorrectPassword); wait != 0 {
+		t.Errorf("got wait %v, want the attempt to go ahead", wait)
+	}
+	if wait := attempt(l, "198.51.100.7", "bob", errAuthDown); wait != DefaultAuthLockout {
+		t.Errorf("got wait %v after two failures, want %v", wait, DefaultAuthLockout)
+	}
+}
+
+func TestBasicAuthWithOptionsLimiter(t *testing.T) {
+	t.Parallel()
+	clock := &fakeClock{time.Unix(1_700_000_000, 0)}
+	h := BasicAuthWithOptions(http.NotFoundHandler(), BasicAuthOptions{
+		Realm:         "admin",
+		Authenticator: StaticUsers(map[string]string{"bob": "secret"}),
+		UniformErrors: true,
+		Limiter:       &AuthLimiter{MaxFailures: 2, now: clock.now},
+	})
+	do := func(user, pass string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "203.0.113.5:1234"
+		req.Header.Set("X-Forwarded-For", "1.2.3.4")
+		req.SetBasicAuth(user, pass)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	var titles []string
+	for _, user := range []string{"bob", "nobody"} {
+		w := do(user, "wrong")
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("%s: got code %d, want 403", user, w.Code)
+		}
+		var body struct {
+			Title string `json:"title"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		titles = append(titles, body.Title)
+	}
+	if titles[0] != titles[1] {
+		t.Errorf("expected identical errors for unknown users and bad passwords, got %q and %q", titles[0], titles[1])
+	}
+
+	w := do("bob", "secret")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got code %d, want 429 even with the right password", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("got Retry-After %q, want 60", got)
+	}
+
+	clock.t = clock.t.Add(time.Minute)
+	if w := do("bob", "secret"); w.Code != http.StatusNotFound {
+		t.Errorf("got code %d after the lockout, want 404 from the wrapped handler", w.Code)
+	}
+}
+
+func TestBasicAuthWithOptionsLimiterConcurrent(t *testing.T) {
+	t.Parallel()
+	var calls atomic.Int32
+	entered, release := make(chan struct{}), make(chan struct{})
+	h := BasicAuthWithOptions(http.NotFoundHandler(), BasicAuthOptions{
+		Realm: "admin",
+		Authenticator: AuthenticatorFunc(func(user, password string) error {
+			calls.Add(1)
+			entered <- struct{}{}
+			<-release
+			return ErrIncorrectPassword
+		}),
+		Limiter: &AuthLimiter{MaxFailures: 3},
+	})
+	do := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "203.0.113.5:1234"
+		req.SetBasicAuth("bob", "wrong")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	const n = 10
+	codes := make(chan int, n)
+	for range n {
+		go func() { codes <- do().Code }()
+	}
+	// Three guesses are checked at once; the rest are turned away without
+	// being checked.
+	for range 3 {
+		<-entered
+	}
+	for range n - 3 {
+		if code := <-codes; code != http.StatusTooManyRequests {
+			t.Errorf("got code %d while guesses were in progress, want 429", code)
+		}
+	}
+	close(release)
+	for range 3 {
+		if code := <-codes; code != http.StatusForbidden {
+			t.Errorf("got code %d, want 403", code)
+		}
+	}
+	if got := calls.Load(); got != 3 {
+		t.Errorf("got %d password checks, want 3", got)
+	}
+	if w := do(); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+		t.Errorf("expected a 60s lockout after three failures, got %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestClientAddrIgnoresForwardedFor(t *testing.T) {
+	t.Parallel()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "203.0.113.5:1234"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	if got := clientAddr(req); got != "203.0.113.5" {
+		t.Errorf("got %q, want the peer address", got)
+	}
+}
@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultCORSMethods are the methods allowed by CORS if no AllowedMethods or
+// Router are configured.
+var DefaultCORSMethods = []string{"GET", "HEAD", "POST"}
+
+// DefaultCORSHeaders are the request headers allowed by CORS if no
+// AllowedHeaders are configured.
+var DefaultCORSHeaders = []string{"Accept", "Content-Type", "X-Requested-With"}
+
+// CORSOptions configures the CORS middleware.
+type CORSOptions struct {
+	// AllowedOrigins lists the origins that may make cross-origin requests,
+	// like "https://example.com". An origin may contain a single "*"
+	// wildcard, like "https://*.example.com", and "*" allows every origin.
+	AllowedOrigins []string
+
+	// AllowedOriginPatterns lists regular expressions matching additional
+	// allowed origins. Anchor them, or they can match unexpected origins.
+	AllowedOriginPatterns []*regexp.Regexp
+
+	// AllowedMethods lists the methods cross-origin requests may use. If
+	// AllowedMethods is empty, the methods accepted by Router for the
+	// request path are used, or DefaultCORSMethods if Router is nil.
+	AllowedMethods []string
+
+	// Router is used to answer preflight requests with only the methods
+	// that routes matching the request path accept, narrowed down to
+	// AllowedMethods if it is set. If Router is nil and the handler passed
+	// to CORS is a *Regexp, that is used.
+	Router *Regexp
+
+	// AllowedHeaders lists the request headers cross-origin requests may
+	// send. If AllowedHeaders is empty, DefaultCORSHeaders is used. "*"
+	// allows every header.
+	AllowedHeaders []string
+
+	// ExposedHeaders lists the response headers, beyond the CORS-safelisted
+	// ones, that scripts may read.
+	ExposedHeaders []string
+
+	// AllowCredentials lets cross-origin requests include cookies and HTTP
+	// authentication. It can't be combined with the "*" origin, since that
+	// would let every site make authenticated requests.
+	AllowCredentials bool
+
+	// MaxAge is how long browsers may cache the result of a preflight
+	// request. It is rounded down to the second. If MaxAge is zero, the
+	// browser default is used.
+	MaxAge time.Duration
+}
+
+type cors struct {
+	h           http.Handler
+	anyOrigin   bool
+	origins     []string
+	wildcards   [][2]string
+	patterns    []*regexp.Regexp
+	methods     []string
+	router      *Regexp
+	anyHeader   bool
+	headers     string
+	exposed     string
+	credentials bool
+	maxAge      string
+}
+
+// CORS adds Cross-Origin Resource Sharing headers to responses for requests
+// from allowed origins, and answers CORS preflight requests (OPTIONS requests
+// with an Access-Control-Request-Method header) without calling h. Requests
+// without an Origin header, and other OPTIONS requests, are passed to h
+// unchanged.
+//
+// CORS panics if AllowCredentials is set and AllowedOrigins contains "*".
+func CORS(h http.Handler, opts CORSOptions) http.Handler {
+	c := &cors{
+		h:           h,
+		patterns:    opts.AllowedOriginPatterns,
+		router:      opts.Router,
+		credentials: opts.AllowCredentials,
+		exposed:     strings.Join(opts.ExposedHeaders, ", "),
+	}
+	for _, origin := range opts.AllowedOrigins {
+		origin = strings.ToLower(origin)
+		if origin == "*" {
+			c.anyOrigin = true
+		} else if prefix, suffix, ok := strings.Cut(origin, "*"); ok {
+			c.wildcards = append(c.wildcards, [2]string{prefix, suffix})
+		} else {
+			c.origins = append(c.origins, origin)
+		}
+	}
+	if c.anyOrigin && c.credentials {
+		panic(`handlers: CORS can't allow credentials for the "*" origin; list the allowed origins instead`)
+	}
+	for _, method := range opts.AllowedMethods {
+		c.methods = append(c.methods, strings.ToUpper(method))
+	}
+	if c.router == nil {
+		c.router, _ = h.(*Regexp)
+	}
+	if len(c.methods) == 0 && c.router == nil {
+		c.methods = DefaultCORSMethods
+	}
+	headers := opts.AllowedHeaders
+	if len(headers) == 0 {
+		headers = DefaultCORSHeaders
+	}
+	c.anyHeader = slices.Contains(headers, "*")
+	c.headers = strings.Join(headers, ", ")
+	if opts.MaxAge > 0 {
+		c.maxAge = strconv.FormatInt(int64(opts.MaxAge/time.Second), 10)
+	}
+	return c
+}
+
+func (c *cors) originAllowed(origin string) bool {
+	if c.anyOrigin {
+		return true
+	}
+	lower := strings.ToLower(origin)
+	if slices.Contains(c.origins, lower) {
+		return true
+	}
+	for _, w := range c.wildcards {
+		if len(lower) >= len(w[0])+len(w[1]) && strings.HasPrefix(lower, w[0]) && strings.HasSuffix(lower, w[1]) {
+			return true
+		}
+	}
+	for _, pattern := range c.patterns {
+		if pattern.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedMethods returns the methods cross-origin requests to path may use.
+func (c *cors) allowedMethods(path string) []string {
+	if c.router == nil {
+		return c.methods
+	}
+	methods := c.router.AllowedMethods(path)
+	if len(c.methods) == 0 {
+		return methods
+	}
+	return slices.DeleteFunc(methods, func(m string) bool {
+		return !slices.Contains(c.methods, m)
+	})
+}
+
+func (c *cors) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+	hdr := w.Header()
+	if preflight {
+		hdr.Add("Vary", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+	} else if !c.anyOrigin {
+		hdr.Add("Vary", "Origin")
+	}
+	if origin == "" || !c.originAllowed(origin) {
+		if preflight {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		c.h.ServeHTTP(w, r)
+		return
+	}
+	if c.anyOrigin {
+		hdr.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		hdr.Set("Access-Control-Allow-Origin", origin)
+	}
+	if c.credentials {
+		hdr.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		if c.exposed != "" {
+			hdr.Set("Access-Control-Expose-Headers", c.exposed)
+		}
+		c.h.ServeHTTP(w, r)
+		return
+	}
+
+	// Browsers compare the requested method and headers with the ones we
+	// list and refuse to send the request if they aren't there, so we don't
+	// need to reject anything here.
+	if methods := c.allowedMethods(r.URL.Path); len(methods) > 0 {
+		hdr.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	}
+	if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+		if c.anyHeader && c.credentials {
+			// "*" is taken literally for credentialed requests, so echo
+			// the requested headers back instead.
+			hdr.Set("Access-Control-Allow-Headers", requested)
+		} else {
+			hdr.Set("Access-Control-Allow-Headers", c.headers)
+		}
+	}
+	if c.maxAge != "" {
+		hdr.Set("Access-Control-Max-Age", c.maxAge)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func corsRequest(method, path, origin string, header http.Header) *http.Request {
+	req := httptest.NewRequest(method, path, nil)
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	return req
+}
+
+func TestCORSOrigins(t *testing.T) {
+	t.Parallel()
+	h := CORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Total-Count", "3")
+	}), CORSOptions{
+		AllowedOrigins:        []string{"https://example.com", "https://*.example.org"},
+		AllowedOriginPatterns: []*regexp.Regexp{regexp.MustCompile(`^http://localhost:\d+$`)},
+		ExposedHeaders:        []string{"X-Total-Count"},
+	})
+	tests := []struct {
+		origin string
+		want   string
+	}{
+		{"https://example.com", "https://example.com"},
+		{"https://EXAMPLE.com", "https://EXAMPLE.com"},
+		{"https://api.example.org", "https://api.example.org"},
+		{"https://example.org", ""},
+		{"https://evil.com", ""},
+		{"http://localhost:3000", "http://localhost:3000"},
+		{"http://localhost:3000.evil.com", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, corsRequest("GET", "/", tt.origin, nil))
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.want {
+			t.Errorf("%q: got Allow-Origin %q, want %q", tt.origin, got, tt.want)
+		}
+		if w.Header().Get("Vary") != "Origin" {
+			t.Errorf("%q: expected Vary: Origin, got %q", tt.origin, w.Header().Get("Vary"))
+		}
+		wantExposed := ""
+		if tt.want != "" {
+			wantExposed = "X-Total-Count"
+		}
+		if got := w.Header().Get("Access-Control-Expose-Headers"); got != wantExposed {
+			t.Errorf("%q: got Expose-Headers %q, want %q", tt.origin, got, wantExposed)
+		}
+		if w.Header().Get("X-Total-Count") != "3" {
+			t.Errorf("%q: handler was not called", tt.origin)
+		}
+	}
+}
+
+func TestCORSAnyOrigin(t *testing.T) {
+	t.Parallel()
+	w := httptest.NewRecorder()
+	CORS(http.NotFoundHandler(), CORSOptions{AllowedOrigins: []string{"*"}}).ServeHTTP(w, corsRequest("GET", "/", "https://a.example", nil))
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("got Allow-Origin %q, want *", got)
+	}
+	if got := w.Header().Get("Vary"); got != "" {
+		t.Errorf("expected no Vary header, got %q", got)
+	}
+}
+
+func TestCORSAnyOriginCredentials(t *testing.T) {
+	t.Parallel()
+	w := httptest.NewRecorder()
+	CORS(http.NotFoundHandler(), CORSOptions{AllowedOrigins: []string{"https://a.example"}, AllowCredentials: true}).ServeHTTP(w, corsRequest("GET", "/", "https://a.example", nil))
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://a.example" {
+		t.Errorf("got Allow-Origin %q with credentials, want the request origin", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("got Allow-Credentials %q", got)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected CORS to panic when allowing credentials for every origin")
+		}
+	}()
+	CORS(http.NotFoundHandler(), CORSOptions{AllowedOrigins: []string{"*"}, AllowCredentials: true})
+}
+
+func TestCORSPreflightRouter(t *testing.T) {
+	t.Parallel()
+	router := new(Regexp)
+	router.HandleStringFunc(`^/jobs$`, []string{"GET", "POST"}, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("handler should not be called for a preflight request")
+	})
+	router.HandleStringFunc(`^/jobs/[^/]+$`, []string{"GET", "DELETE"}, func(w http.ResponseWriter, r *http.Request) {})
+	h := CORS(router, CORSOptions{
+		AllowedOrigins: []string{"https://example.com"},
+		AllowedHeaders: []string{"Content-Type", "Authorization"},
+		MaxAge:         10 * time.Minute,
+	})
+	preflight := http.Header{
+		"Access-Control-Request-Method":  {"POST"},
+		"Access-Control-Request-Headers": {"content-type"},
+	}
+	tests := []struct {
+		path    string
+		methods string
+	}{
+		{"/jobs", "GET, HEAD, POST"},
+		{"/jobs/build", "GET, HEAD, DELETE"},
+		{"/missing", ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, corsRequest("OPTIONS", tt.path, "https://example.com", preflight))
+		if w.Code != http.StatusNoContent {
+			t.Errorf("%s: got code %d, want 204", tt.path, w.Code)
+		}
+		want := map[string]string{
+			"Access-Control-Allow-Origin":  "https://example.com",
+			"Access-Control-Allow-Methods": tt.methods,
+			"Access-Control-Allow-Headers": "Content-Type, Authorization",
+			"Access-Control-Max-Age":       "600",
+		}
+		for name, value := range want {
+			if got := w.Header().Get(name); got != value {
+				t.Errorf("%s: got %s %q, want %q", tt.path, name, got, value)
+			}
+		}
+	}
+
+	// Narrowed down by AllowedMethods.
+	h = CORS(router, CORSOptions{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"get", "head"}})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, corsRequest("OPTIONS", "/jobs/build", "https://example.com", preflight))
+	if got := w.Header().Get("Access-Control-Allow-Methods"); got != "GET, HEAD" {
+		t.Errorf("got Allow-Methods %q, want GET, HEAD", got)
+	}
+
+	// Plain OPTIONS requests still reach the router.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, corsRequest("OPTIONS", "/jobs", "https://example.com", nil))
+	if got := w.Header().Get("Allow"); got != "GET, POST, OPTIONS" {
+		t.Errorf("got Allow %q", got)
+	}
+}
+
+func TestCORSPreflightDisallowedOrigin(t *testing.T) {
+	t.Parallel()
+	h := CORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("handler should not be called for a preflight request")
+	}), CORSOptions{AllowedOrigins: []string{"https://example.com"}})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, corsRequest("OPTIONS", "/", "https://evil.com", http.Header{"Access-Control-Request-Method": {"PUT"}}))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("got code %d, want 204", w.Code)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("expected no Allow-Origin header, got %q", got)
+	}
+}
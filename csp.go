@@ -0,0 +1,322 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/kevinburke/rest/v2"
+	"github.com/kevinburke/rest/v2/resterror"
+)
+
+// Source expressions for use with a CSPPolicy.
+const (
+	CSPSelf           = "'self'"
+	CSPNone           = "'none'"
+	CSPUnsafeInline   = "'unsafe-inline'"
+	CSPUnsafeEval     = "'unsafe-eval'"
+	CSPStrictDynamic  = "'strict-dynamic'"
+	CSPWasmUnsafeEval = "'wasm-unsafe-eval'"
+	CSPData           = "data:"
+	CSPBlob           = "blob:"
+	CSPHTTPS          = "https:"
+
+	// CSPNonce is replaced with a fresh 'nonce-...' source on every request
+	// by the CSP and CSPReportOnly handlers. Retrieve the nonce with
+	// GetCSPNonce and put it in the nonce attribute of your script and style
+	// tags.
+	CSPNonce = "'nonce'"
+)
+
+type cspDirective struct {
+	name    string
+	sources []string
+}
+
+// A CSPPolicy builds a Content-Security-Policy header value. Its methods add
+// sources to a directive and return the policy, so calls can be chained:
+//
+//	policy := handlers.NewCSPPolicy().
+//		DefaultSrc(handlers.CSPSelf).
+//		ScriptSrc(handlers.CSPNonce, handlers.CSPStrictDynamic).
+//		ObjectSrc(handlers.CSPNone).
+//		ReportURI("/csp-report")
+//
+// Directives appear in the header in the order they were first added. Don't
+// modify a CSPPolicy after passing it to CSP or CSPReportOnly.
+type CSPPolicy struct {
+	directives []cspDirective
+}
+
+// NewCSPPolicy returns an empty policy.
+func NewCSPPolicy() *CSPPolicy {
+	return &CSPPolicy{}
+}
+
+// Directive adds sources to the directive with the given name. Use it for
+// directives that don't have their own method.
+func (p *CSPPolicy) Directive(name string, sources ...string) *CSPPolicy {
+	name = strings.ToLower(name)
+	for i := range p.directives {
+		if p.directives[i].name == name {
+			p.directives[i].sources = append(p.directives[i].sources, sources...)
+			return p
+		}
+	}
+	p.directives = append(p.directives, cspDirective{name: name, sources: sources})
+	return p
+}
+
+// DefaultSrc adds sources to the default-src directive.
+func (p *CSPPolicy) DefaultSrc(sources ...string) *CSPPolicy {
+	return p.Directive("default-src", sources...)
+}
+
+// ScriptSrc adds sources to the script-src directive.
+func (p *CSPPolicy) ScriptSrc(sources ...string) *CSPPolicy {
+	return p.Directive("script-src", sources...)
+}
+
+// StyleSrc adds sources to the style-src directive.
+func (p *CSPPolicy) StyleSrc(sources ...string) *CSPPolicy {
+	return p.Directive("style-src", sources...)
+}
+
+// ImgSrc adds sources to the img-src directive.
+func (p *CSPPolicy) ImgSrc(sources ...string) *CSPPolicy {
+	return p.Directive("img-src", sources...)
+}
+
+// FontSrc adds sources to the font-src directive.
+func (p *CSPPolicy) FontSrc(sources ...string) *CSPPolicy {
+	return p.Directive("font-src", sources...)
+}
+
+// ConnectSrc adds sources to the connect-src directive.
+func (p *CSPPolicy) ConnectSrc(sources ...string) *CSPPolicy {
+	return p.Directive("connect-src", sources...)
+}
+
+// MediaSrc adds sources to the media-src directive.
+func (p *CSPPolicy) MediaSrc(sources ...string) *CSPPolicy {
+	return p.Directive("media-src", sources...)
+}
+
+// ObjectSrc adds sources to the object-src directive.
+func (p *CSPPolicy) ObjectSrc(sources ...string) *CSPPolicy {
+	return p.Directive("object-src", sources...)
+}
+
+// FrameSrc adds sources to the frame-src directive.
+func (p *CSPPolicy) FrameSrc(sources ...string) *CSPPolicy {
+	return p.Directive("frame-src", sources...)
+}
+
+// WorkerSrc adds sources to the worker-src directive.
+func (p *CSPPolicy) WorkerSrc(sources ...string) *CSPPolicy {
+	return p.Directive("worker-src", sources...)
+}
+
+// FrameAncestors adds sources to the frame-ancestors directive.
+func (p *CSPPolicy) FrameAncestors(sources ...string) *CSPPolicy {
+	return p.Directive("frame-ancestors", sources...)
+}
+
+// BaseURI adds sources to the base-uri directive.
+func (p *CSPPolicy) BaseURI(sources ...string) *CSPPolicy {
+	return p.Directive("base-uri", sources...)
+}
+
+// FormAction adds sources to the form-action directive.
+func (p *CSPPolicy) FormAction(sources ...string) *CSPPolicy {
+	return p.Directive("form-action", sources...)
+}
+
+// UpgradeInsecureRequests adds the upgrade-insecure-requests directive.
+func (p *CSPPolicy) UpgradeInsecureRequests() *CSPPolicy {
+	return p.Directive("upgrade-insecure-requests")
+}
+
+// ReportURI sets the URI browsers send violation reports to. Mount
+// CSPReportHandler there to log them.
+func (p *CSPPolicy) ReportURI(uri string) *CSPPolicy {
+	return p.Directive("report-uri", uri)
+}
+
+// ReportTo sets the Reporting API endpoint group browsers send violation
+// reports to. The group must be defined in a Reporting-Endpoints header.
+func (p *CSPPolicy) ReportTo(group string) *CSPPolicy {
+	return p.Directive("report-to", group)
+}
+
+// String returns the policy as a header value, with any CSPNonce sources
+// left in place.
+func (p *CSPPolicy) String() string {
+	var b strings.Builder
+	for i, d := range p.directives {
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		b.WriteString(d.name)
+		for _, source := range d.sources {
+			b.WriteByte(' ')
+			b.WriteString(source)
+		}
+	}
+	return b.String()
+}
+
+// CSP sets a Content-Security-Policy header built from policy on the
+// response. A random nonce is generated for every request and stored on the
+// request context, where it can be retrieved with GetCSPNonce; CSPNonce
+// sources in the policy are replaced with it.
+func CSP(h http.Handler, policy *CSPPolicy) http.Handler {
+	return cspHandler(h, policy, "Content-Security-Policy")
+}
+
+// CSPReportOnly is like CSP, but sets a Content-Security-Policy-Report-Only
+// header, so browsers report violations of the policy instead of blocking
+// them. Use it to try out a policy before enforcing it.
+func CSPReportOnly(h http.Handler, policy *CSPPolicy) http.Handler {
+	return cspHandler(h, policy, "Content-Security-Policy-Report-Only")
+}
+
+func cspHandler(h http.Handler, policy *CSPPolicy, header string) http.Handler {
+	value := policy.String()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce := newCSPNonce()
+		w.Header().Set(header, strings.ReplaceAll(value, CSPNonce, "'nonce-"+nonce+"'"))
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), cspNonce, nonce)))
+	})
+}
+
+func newCSPNonce() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(b[:])
+}
+
+// GetCSPNonce returns the nonce generated by the CSP or CSPReportOnly handler
+// for this request, or false if neither ran.
+func GetCSPNonce(ctx context.Context) (string, bool) {
+	nonce, ok := ctx.Value(cspNonce).(string)
+	return nonce, ok
+}
+
+// maxCSPReportSize is the largest violation report CSPReportHandler accepts.
+const maxCSPReportSize = 64 * 1024
+
+// cspReport is the body of a violation report, in either the report-uri
+// format (with dashed names) or the Reporting API format (camel case).
+type cspReport struct {
+	DocumentURI        string `json:"document-uri"`
+	Referrer           string `json:"referrer"`
+	ViolatedDirective  string `json:"violated-directive"`
+	EffectiveDirective string `json:"effective-directive"`
+	BlockedURI         string `json:"blocked-uri"`
+	Disposition        string `json:"disposition"`
+	SourceFile         string `json:"source-file"`
+	LineNumber         int    `json:"line-number"`
+	ScriptSample       string `json:"script-sample"`
+
+	DocumentURL           string `json:"documentURL"`
+	EffectiveDirectiveAPI string `json:"effectiveDirective"`
+	BlockedURL            string `json:"blockedURL"`
+	SourceFileAPI         string `json:"sourceFile"`
+	LineNumberAPI         int    `json:"lineNumber"`
+	Sample                string `json:"sample"`
+}
+
+func (c *cspReport) log(r *http.Request) {
+	document, directive, blocked := c.DocumentURI, c.EffectiveDirective, c.BlockedURI
+	if document == "" {
+		document = c.DocumentURL
+	}
+	if directive == "" {
+		directive = c.EffectiveDirectiveAPI
+	}
+	if directive == "" {
+		directive = c.ViolatedDirective
+	}
+	if blocked == "" {
+		blocked = c.BlockedURL
+	}
+	source, line, sample := c.SourceFile, c.LineNumber, c.ScriptSample
+	if source == "" {
+		source, line = c.SourceFileAPI, c.LineNumberAPI
+	}
+	if sample == "" {
+		sample = c.Sample
+	}
+	Logger.Warn("CSP violation", "document_uri", document, "directive", directive,
+		"blocked_uri", blocked, "disposition", c.Disposition, "source_file", source,
+		"line_number", line, "sample", sample, "user_agent", r.UserAgent())
+}
+
+// CSPReportHandler returns a handler that accepts Content-Security-Policy
+// violation reports, in either the report-uri format or the Reporting API
+// format, and logs them to Logger. Mount it at the URI passed to
+// CSPPolicy.ReportURI or listed in your Reporting-Endpoints header.
+func CSPReportHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			rest.NotAllowed(w, r)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCSPReportSize))
+		if maxErr := new(http.MaxBytesError); errors.As(err, &maxErr) {
+			writeError(w, r, http.StatusRequestEntityTooLarge, &resterror.Error{
+				Title: fmt.Sprintf("CSP report is larger than the maximum of %d bytes", maxErr.Limit),
+				ID:    "request_entity_too_large",
+			})
+			return
+		}
+		if err != nil {
+			rest.BadRequest(w, r, &resterror.Error{
+				Title:    "Could not read CSP report: " + err.Error(),
+				ID:       "invalid_csp_report",
+				Instance: r.URL.Path,
+			})
+			return
+		}
+		var reports []cspReport
+		if strings.HasPrefix(strings.TrimSpace(string(body)), "[") {
+			var batch []struct {
+				Type string    `json:"type"`
+				Body cspReport `json:"body"`
+			}
+			err = json.Unmarshal(body, &batch)
+			for _, report := range batch {
+				if report.Type == "csp-violation" {
+					reports = append(reports, report.Body)
+				}
+			}
+		} else {
+			var single struct {
+				Report cspReport `json:"csp-report"`
+			}
+			err = json.Unmarshal(body, &single)
+			reports = append(reports, single.Report)
+		}
+		if err != nil {
+			rest.BadRequest(w, r, &resterror.Error{
+				Title:    "Could not parse CSP report: " + err.Error(),
+				ID:       "invalid_csp_report",
+				Instance: r.URL.Path,
+			})
+			return
+		}
+		for i := range reports {
+			reports[i].log(r)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
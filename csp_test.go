@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCSPPolicyString(t *testing.T) {
+	t.Parallel()
+	policy := NewCSPPolicy().
+		DefaultSrc(CSPSelf).
+		ScriptSrc(CSPNonce, CSPStrictDynamic).
+		ObjectSrc(CSPNone).
+		ScriptSrc("https://cdn.example").
+		UpgradeInsecureRequests().
+		ReportURI("/csp-report")
+	want := "default-src 'self'; script-src 'nonce' 'strict-dynamic' https://cdn.example; object-src 'none'; upgrade-insecure-requests; report-uri /csp-report"
+	if got := policy.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCSPNonce(t *testing.T) {
+	t.Parallel()
+	var nonces []string
+	h := CSP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce, ok := GetCSPNonce(r.Context())
+		if !ok {
+			t.Error("no nonce on request context")
+		}
+		nonces = append(nonces, nonce)
+	}), NewCSPPolicy().ScriptSrc(CSPNonce))
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		want := "script-src 'nonce-" + nonces[i] + "'"
+		if got := w.Header().Get("Content-Security-Policy"); got != want {
+			t.Errorf("got header %q, want %q", got, want)
+		}
+	}
+	if len(nonces[0]) != 24 {
+		t.Errorf("expected a 16 byte base64 nonce, got %q", nonces[0])
+	}
+	if nonces[0] == nonces[1] {
+		t.Errorf("expected a new nonce for each request, got %q twice", nonces[0])
+	}
+	if _, ok := GetCSPNonce(httptest.NewRequest("GET", "/", nil).Context()); ok {
+		t.Error("expected no nonce without the CSP handler")
+	}
+}
+
+func TestCSPReportOnly(t *testing.T) {
+	t.Parallel()
+	h := CSPReportOnly(http.NotFoundHandler(), NewCSPPolicy().DefaultSrc(CSPSelf))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if got := w.Header().Get("Content-Security-Policy-Report-Only"); got != "default-src 'self'" {
+		t.Errorf("got Report-Only header %q", got)
+	}
+	if got := w.Header().Get("Content-Security-Policy"); got != "" {
+		t.Errorf("expected no enforcing header, got %q", got)
+	}
+}
+
+func TestCSPReportHandlerErrors(t *testing.T) {
+	t.Parallel()
+	h := CSPReportHandler()
+	tests := []struct {
+		method string
+		body   string
+		code   int
+	}{
+		{"GET", "", http.StatusMethodNotAllowed},
+		{"POST", "{", http.StatusBadRequest},
+		{"POST", `{"csp-report": "` + strings.Repeat("a", maxCSPReportSize) + `"}`, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(tt.method, "/csp-report", strings.NewReader(tt.body)))
+		if w.Code != tt.code {
+			t.Errorf("%s %.20q: got code %d, want %d", tt.method, tt.body, w.Code, tt.code)
+		}
+	}
+}
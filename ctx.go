@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"context"
+	"io"
 	"net/http"
 	"strings"
 	"time"
@@ -14,6 +15,11 @@ type ctxVar int
 var requestID ctxVar = 0
 var startTime ctxVar = 1
 var extraLog ctxVar = 2
+var pathParams ctxVar = 3
+var realIP ctxVar = 4
+var cspNonce ctxVar = 5
+var principal ctxVar = 6
+var jwtClaims ctxVar = 7
 
 // SetRequestID sets the given UUID on the request context and returns the
 // modified HTTP request.
@@ -66,7 +72,7 @@ func getStart(ctx context.Context) time.Time {
 }
 
 type startWriter struct {
-	w           http.ResponseWriter
+	baseWriter
 	start       time.Time
 	wroteHeader bool
 }
@@ -76,33 +82,30 @@ func (s *startWriter) duration() string {
 	return strings.Replace(d.String(), "µ", "u", 1)
 }
 
-func (s *startWriter) WriteHeader(code int) {
+func (s *startWriter) setHeader() {
 	//lint:ignore S1002 prefer it this way
 	if s.wroteHeader == false {
 		s.w.Header().Set("X-Request-Duration", s.duration())
 		s.wroteHeader = true
 	}
+}
+
+func (s *startWriter) WriteHeader(code int) {
+	s.setHeader()
 	s.w.WriteHeader(code)
 }
 
 func (s *startWriter) Write(b []byte) (int, error) {
 	// Some chunked encoding transfers won't ever call WriteHeader(), so set
 	// the header here.
-	//lint:ignore S1002 prefer it this way
-	if s.wroteHeader == false {
-		s.w.Header().Set("X-Request-Duration", s.duration())
-		s.wroteHeader = true
-	}
+	s.setHeader()
 	return s.w.Write(b)
 }
 
-func (s *startWriter) Header() http.Header {
-	return s.w.Header()
-}
-
-// Push implements the http.Pusher interface.
-func (s *startWriter) Push(target string, opts *http.PushOptions) error {
-	return push(s.w, target, opts)
+// ReadFrom implements the io.ReaderFrom interface.
+func (s *startWriter) ReadFrom(r io.Reader) (int64, error) {
+	s.setHeader()
+	return readFrom(s.w, s.w, r)
 }
 
 // Duration sets the start time in the context and sets a X-Request-Duration
@@ -111,18 +114,14 @@ func (s *startWriter) Push(target string, opts *http.PushOptions) error {
 func Duration(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		sw := &startWriter{
-			w:           w,
+			baseWriter:  baseWriter{w: w},
 			start:       time.Now().UTC(),
 			wroteHeader: false,
 		}
 		r2 := r.WithContext(context.WithValue(r.Context(), startTime, sw.start))
-		h.ServeHTTP(sw, r2)
-		//lint:ignore S1002 prefer it this way
-		if sw.wroteHeader == false {
-			// never called Write() or WriteHeader()
-			sw.w.Header().Set("X-Request-Duration", sw.duration())
-			sw.wroteHeader = true
-		}
+		h.ServeHTTP(wrapWriter(w, sw), r2)
+		// in case we never called Write() or WriteHeader()
+		sw.setHeader()
 	})
 }
 
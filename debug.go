@@ -0,0 +1,539 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var envFunc = os.Getenv
+
+// DefaultDebugMaxBodyBytes is the default value for
+// DebugOptions.MaxBodyBytes.
+const DefaultDebugMaxBodyBytes = 64 * 1024
+
+// DebugOptions configures the DebugWithOptions handler.
+type DebugOptions struct {
+	// Output is where request and response dumps are written. If Output is
+	// nil, os.Stderr is used.
+	Output io.Writer
+
+	// MaxBodyBytes is the maximum number of bytes of the request body, and
+	// of the response body, that are included in a dump. The rest of the
+	// body is still sent to the handler or the client, but omitted from the
+	// dump. If MaxBodyBytes is zero, DefaultDebugMaxBodyBytes is used; set
+	// a negative value to capture entire bodies. Only the part of the
+	// request body that the handler reads is dumped.
+	MaxBodyBytes int
+
+	// RedactHeaders lists request and response headers whose values are
+	// replaced with "[REDACTED]" in dumps. Names are case insensitive. If
+	// RedactHeaders is nil, DefaultDebugRedactHeaders is used; set it to an
+	// empty slice to dump every header verbatim.
+	RedactHeaders []string
+
+	// RedactFields lists JSON object keys and form fields, like "password",
+	// whose values are replaced with "[REDACTED]" in dumped request and
+	// response bodies and in the request's query string. Names are case
+	// insensitive. Array and object values are replaced whole, and keys are
+	// matched at any depth.
+	RedactFields []string
+
+	// Scrub, if not nil, is called with each complete dump, after any other
+	// redaction, and its return value is written to Output instead.
+	Scrub func(dump []byte) []byte
+
+	// Enabled reports whether to dump the given request. If Enabled is nil,
+	// DebugEnv is used. See DebugHeader, DebugPathPrefix, DebugSample and
+	// DebugSwitch for other ways to choose which requests are dumped.
+	Enabled DebugPredicate
+
+	// Format controls how each exchange is written to Output. The default,
+	// DebugText, writes HTTP wire text.
+	Format DebugFormat
+
+	// HAR, if not nil, records every dumped exchange as an entry in a HAR
+	// 1.2 log, in addition to writing it to Output. Scrub is not applied to
+	// HAR entries.
+	HAR *HARLog
+}
+
+// DebugFormat controls the output of DebugWithOptions.
+type DebugFormat int
+
+const (
+	// DebugText writes the request and response as HTTP wire text.
+	DebugText DebugFormat = iota
+	// DebugJSON writes each request and response as a single line of JSON,
+	// including timings and the request ID, for ingestion by log pipelines.
+	DebugJSON
+)
+
+// DefaultDebugRedactHeaders lists the headers that are redacted from dumps by
+// default.
+var DefaultDebugRedactHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	DebugTraceHeader,
+}
+
+// Debug prints debugging information about the request to output if the
+// DEBUG_HTTP_TRAFFIC environment variable is set to "true".
+func DebugWriter(h http.Handler, output io.Writer) http.Handler {
+	return DebugWithOptions(h, &DebugOptions{Output: output})
+}
+
+// Debug prints debugging information about the request to stderr if the
+// DEBUG_HTTP_TRAFFIC environment variable is set to "true".
+func Debug(h http.Handler) http.Handler {
+	return DebugWithOptions(h, nil)
+}
+
+// DebugWithOptions prints the request and response to opts.Output for
+// requests selected by opts.Enabled; by default, every request if the
+// DEBUG_HTTP_TRAFFIC environment variable is set to "true". The response is
+// streamed to the client as the handler writes it, so Flush, server-sent
+// events and large downloads work as they would without DebugWithOptions;
+// only the first opts.MaxBodyBytes of each body are kept for the dump, which
+// is written once the handler returns. opts may be nil.
+func DebugWithOptions(h http.Handler, opts *DebugOptions) http.Handler {
+	d := &debugger{
+		output:        os.Stderr,
+		maxBody:       DefaultDebugMaxBodyBytes,
+		redactHeaders: DefaultDebugRedactHeaders,
+	}
+	enabled := DebugEnv
+	if opts != nil {
+		if opts.Output != nil {
+			d.output = opts.Output
+		}
+		if opts.MaxBodyBytes < 0 {
+			d.maxBody = -1
+		} else if opts.MaxBodyBytes > 0 {
+			d.maxBody = opts.MaxBodyBytes
+		}
+		if opts.RedactHeaders != nil {
+			d.redactHeaders = opts.RedactHeaders
+		}
+		d.fields = newFieldRedactor(opts.RedactFields)
+		d.scrub = opts.Scrub
+		d.format = opts.Format
+		d.har = opts.HAR
+		if opts.Enabled != nil {
+			enabled = opts.Enabled
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !enabled(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		d.serveHTTP(h, w, r)
+	})
+}
+
+// debugger holds the resolved DebugOptions for a DebugWithOptions handler.
+type debugger struct {
+	output        io.Writer
+	maxBody       int
+	redactHeaders []string
+	fields        *fieldRedactor
+	scrub         func([]byte) []byte
+	format        DebugFormat
+	har           *HARLog
+}
+
+// debugExchange is a captured request and response, with redactions
+// applied.
+type debugExchange struct {
+	start     time.Time
+	duration  time.Duration
+	requestID string
+
+	method    string
+	url       string
+	proto     string
+	reqDump   []byte // request line and headers, as wire text
+	reqErr    error
+	reqHeader http.Header
+	reqBody   debugBody
+
+	status     int
+	respHeader http.Header
+	respBody   debugBody
+}
+
+// debugBody is a captured request or response body.
+type debugBody struct {
+	contentType string
+	data        []byte
+	// size is the size of the body as sent, which may be compressed.
+	size int64
+	// omitted is the number of bytes left out of data.
+	omitted int64
+	// binary is true if data was not captured because it's compressed with
+	// an encoding we can't decode.
+	binary bool
+	// decoded is the Content-Encoding that data was decoded from, if any.
+	decoded string
+	// truncated is true if data was decoded but the decoded body was larger
+	// than the capture limit, or the compressed body was cut short.
+	truncated bool
+	// unread is true if the handler did not read the whole request body;
+	// data holds the part it did read.
+	unread bool
+}
+
+func (d *debugger) serveHTTP(h http.Handler, w http.ResponseWriter, r *http.Request) {
+	start := GetStartTime(r.Context())
+	if start.IsZero() {
+		start = time.Now()
+	}
+	ex := &debugExchange{
+		start:     start,
+		method:    r.Method,
+		proto:     r.Proto,
+		reqHeader: redactHeader(r.Header, d.redactHeaders),
+	}
+	dumpReq := *r
+	dumpReq.Header = ex.reqHeader
+	dumpReq.RequestURI = d.fields.redactRequestURI(r.RequestURI)
+	ex.reqDump, ex.reqErr = httputil.DumpRequest(&dumpReq, false)
+	ex.url = requestURL(r, d.fields.redactRequestURI(r.URL.RequestURI()))
+
+	reqBody := &cappedBuffer{max: d.maxBody}
+	var tee *teeReadCloser
+	if r.Body != nil && r.Body != http.NoBody {
+		r = r.WithContext(r.Context())
+		tee = &teeReadCloser{ReadCloser: r.Body, w: reqBody}
+		r.Body = tee
+	}
+	dw := &debugWriter{baseWriter: baseWriter{w: w}, body: cappedBuffer{max: d.maxBody}}
+	h.ServeHTTP(wrapWriter(w, dw), r)
+	ex.duration = time.Since(start)
+
+	if id, ok := GetRequestID(r.Context()); ok {
+		ex.requestID = id.String()
+	} else {
+		ex.requestID = r.Header.Get("X-Request-Id")
+	}
+	ex.reqBody = d.body(r.Header, reqBody)
+	// Don't read the rest of the body ourselves: the handler may have
+	// declined a large upload on purpose.
+	ex.reqBody.unread = tee != nil && !tee.done(r.ContentLength)
+	if dw.header == nil {
+		dw.snapshot(http.StatusOK)
+	}
+	ex.status = dw.status
+	ex.respHeader = redactHeader(dw.header, d.redactHeaders)
+	ex.respBody = d.body(dw.header, &dw.body)
+
+	if d.har != nil {
+		d.har.add(ex)
+	}
+	var dump []byte
+	switch d.format {
+	case DebugJSON:
+		dump = ex.json()
+	default:
+		dump = ex.text()
+	}
+	if d.scrub != nil {
+		dump = d.scrub(dump)
+	}
+	// You need to write the entire thing in one Write, otherwise the
+	// output will be jumbled with other requests.
+	_, _ = d.output.Write(dump)
+}
+
+// body returns the captured body, with any configured fields redacted.
+// Bodies compressed with gzip or deflate are decompressed, up to the capture
+// limit.
+func (d *debugger) body(header http.Header, c *cappedBuffer) debugBody {
+	body := debugBody{
+		contentType: header.Get("Content-Type"),
+		size:        int64(c.buf.Len()) + c.dropped,
+		omitted:     c.dropped,
+	}
+	data := c.buf.Bytes()
+	if coding := header.Get("Content-Encoding"); coding != "" && !strings.EqualFold(coding, "identity") {
+		decoded, truncated, ok := d.decode(coding, data)
+		if !ok {
+			body.binary = true
+			return body
+		}
+		data = decoded
+		body.decoded = coding
+		body.truncated = truncated || c.dropped > 0
+		body.omitted = 0
+	}
+	body.data = d.fields.redactBody(body.contentType, data)
+	return body
+}
+
+// decode decompresses data, which may be truncated, with the given
+// content-coding. It returns false if the coding is not supported or the data
+// could not be decoded at all.
+func (d *debugger) decode(coding string, data []byte) (decoded []byte, truncated bool, ok bool) {
+	name := strings.ToLower(strings.TrimSpace(coding))
+	if name == "x-gzip" {
+		name = "gzip"
+	}
+	dec, ok := findDecoding([]Decoding{GzipDecoding, DeflateDecoding}, name)
+	if !ok {
+		return nil, false, false
+	}
+	rc, err := dec.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, false, false
+	}
+	defer rc.Close()
+	var r io.Reader = rc
+	if d.maxBody >= 0 {
+		r = io.LimitReader(rc, int64(d.maxBody)+1)
+	}
+	decoded, err = io.ReadAll(r)
+	if err != nil && len(decoded) == 0 {
+		return nil, false, false
+	}
+	// A read error here most likely means that the compressed data was cut
+	// off by the capture limit.
+	truncated = err != nil
+	if d.maxBody >= 0 && len(decoded) > d.maxBody {
+		decoded = decoded[:d.maxBody]
+		truncated = true
+	}
+	return decoded, truncated, true
+}
+
+// requestURL reconstructs the absolute URL for r, using uri as the path and
+// query.
+func requestURL(r *http.Request, uri string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + uri
+}
+
+// text renders the exchange as HTTP wire text.
+func (ex *debugExchange) text() []byte {
+	b := new(bytes.Buffer)
+	if ex.reqErr != nil {
+		_, _ = b.WriteString(ex.reqErr.Error())
+	} else {
+		_, _ = b.Write(ex.reqDump)
+		ex.reqBody.writeTo(b)
+	}
+	_, _ = fmt.Fprintf(b, "%s %d\r\n", ex.proto, ex.status)
+	_ = ex.respHeader.Write(b)
+	_, _ = b.WriteString("\r\n")
+	ex.respBody.writeTo(b)
+	return b.Bytes()
+}
+
+func (body debugBody) writeTo(b *bytes.Buffer) {
+	if body.binary {
+		_, _ = b.WriteString("[binary data omitted]")
+		return
+	}
+	b.Write(body.data)
+	if body.omitted > 0 {
+		fmt.Fprintf(b, "[%d more bytes omitted]", body.omitted)
+	}
+	if body.truncated {
+		_, _ = b.WriteString("[decoded body truncated]")
+	}
+	if body.unread {
+		_, _ = b.WriteString("[rest of body not read by handler]")
+	}
+}
+
+type debugRecord struct {
+	Time       time.Time           `json:"time"`
+	DurationMs float64             `json:"duration_ms"`
+	RequestID  string              `json:"request_id,omitempty"`
+	Request    debugRecordRequest  `json:"request"`
+	Response   debugRecordResponse `json:"response"`
+}
+
+type debugRecordRequest struct {
+	Method  string      `json:"method"`
+	URL     string      `json:"url"`
+	Proto   string      `json:"proto"`
+	Headers http.Header `json:"headers"`
+	debugRecordBody
+}
+
+type debugRecordResponse struct {
+	Status  int         `json:"status"`
+	Headers http.Header `json:"headers"`
+	debugRecordBody
+}
+
+type debugRecordBody struct {
+	Body string `json:"body,omitempty"`
+	// BodyEncoding is "base64" if Body is not valid UTF-8, or "omitted" if
+	// the body is compressed and was not captured.
+	BodyEncoding     string `json:"body_encoding,omitempty"`
+	BodyOmittedBytes int64  `json:"body_omitted_bytes,omitempty"`
+	// BodyDecodedFrom is the Content-Encoding that Body was decompressed
+	// from, if any.
+	BodyDecodedFrom string `json:"body_decoded_from,omitempty"`
+	BodyTruncated   bool   `json:"body_truncated,omitempty"`
+	// BodyUnread is true if the handler did not read the whole request
+	// body, and Body only holds the part it read.
+	BodyUnread bool `json:"body_unread,omitempty"`
+}
+
+func (body debugBody) record() debugRecordBody {
+	rec := debugRecordBody{
+		BodyOmittedBytes: body.omitted,
+		BodyDecodedFrom:  body.decoded,
+		BodyTruncated:    body.truncated,
+		BodyUnread:       body.unread,
+	}
+	switch {
+	case body.binary:
+		rec.BodyEncoding = "omitted"
+	case utf8.Valid(body.data):
+		rec.Body = string(body.data)
+	default:
+		rec.Body = base64.StdEncoding.EncodeToString(body.data)
+		rec.BodyEncoding = "base64"
+	}
+	return rec
+}
+
+// json renders the exchange as a single line of JSON.
+func (ex *debugExchange) json() []byte {
+	rec := debugRecord{
+		Time:       ex.start,
+		DurationMs: float64(ex.duration) / float64(time.Millisecond),
+		RequestID:  ex.requestID,
+		Request: debugRecordRequest{
+			Method:          ex.method,
+			URL:             ex.url,
+			Proto:           ex.proto,
+			Headers:         ex.reqHeader,
+			debugRecordBody: ex.reqBody.record(),
+		},
+		Response: debugRecordResponse{
+			Status:          ex.status,
+			Headers:         ex.respHeader,
+			debugRecordBody: ex.respBody.record(),
+		},
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		// can't happen, all of the types can be marshaled.
+		return []byte(err.Error() + "\n")
+	}
+	return append(b, '\n')
+}
+
+// debugWriter passes writes through to the client, keeping a copy of the
+// status code, headers and the start of the body.
+type debugWriter struct {
+	baseWriter
+	hijacked bool
+	status   int
+	header   http.Header
+	body     cappedBuffer
+}
+
+// snapshot records the status code and a copy of the headers that are about
+// to be sent to the client.
+func (d *debugWriter) snapshot(code int) {
+	if d.header != nil {
+		return
+	}
+	d.status = code
+	d.header = d.w.Header().Clone()
+}
+
+func (d *debugWriter) WriteHeader(code int) {
+	if code >= 200 {
+		d.snapshot(code)
+	}
+	d.w.WriteHeader(code)
+}
+
+func (d *debugWriter) Write(b []byte) (int, error) {
+	d.snapshot(http.StatusOK)
+	n, err := d.w.Write(b)
+	d.body.Write(b[:n])
+	return n, err
+}
+
+// Hijack implements the http.Hijacker interface.
+func (d *debugWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := d.baseWriter.Hijack()
+	if err == nil {
+		d.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// ReadFrom implements the io.ReaderFrom interface.
+func (d *debugWriter) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(writerOnly{d}, r)
+}
+
+// cappedBuffer keeps the first max bytes written to it, and counts the rest.
+// If max is negative, every byte is kept.
+type cappedBuffer struct {
+	buf     bytes.Buffer
+	max     int
+	dropped int64
+}
+
+// Write always reports success, so it can be used with io.TeeReader.
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if c.max >= 0 {
+		if room := c.max - c.buf.Len(); room < len(p) {
+			c.dropped += int64(len(p) - max(room, 0))
+			p = p[:max(room, 0)]
+		}
+	}
+	c.buf.Write(p)
+	return n, nil
+}
+
+type teeReadCloser struct {
+	io.ReadCloser
+	w   io.Writer
+	n   int64
+	eof bool
+}
+
+func (t *teeReadCloser) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 {
+		t.w.Write(p[:n])
+		t.n += int64(n)
+	}
+	if err == io.EOF {
+		t.eof = true
+	}
+	return n, err
+}
+
+// done reports whether the whole body was read, given its Content-Length,
+// which is -1 if unknown.
+func (t *teeReadCloser) done(contentLength int64) bool {
+	return t.eof || contentLength >= 0 && t.n >= contentLength
+}
@@ -0,0 +1,352 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultHARMaxEntries is the number of entries a HARLog keeps if no
+// MaxEntries is set.
+const DefaultHARMaxEntries = 1000
+
+// A HARLog records the exchanges dumped by DebugWithOptions in the HTTP
+// Archive (HAR) 1.2 format, which can be loaded into browser developer tools.
+// Only the most recent MaxEntries exchanges are kept in memory.
+//
+// A HARLog is safe for concurrent use.
+type HARLog struct {
+	// MaxEntries is the number of entries to keep; older entries are
+	// dropped. If zero, DefaultHARMaxEntries is used, and if negative, every
+	// entry is kept. Set it before the HARLog is used.
+	MaxEntries int
+
+	path string
+
+	mu      sync.Mutex
+	entries []harEntry // a ring buffer once it's full
+	next    int        // the index of the oldest entry once entries is full
+	version int        // incremented every time entries changes
+	closed  bool
+
+	// writeMu serializes writes to path, so an older snapshot of the log
+	// never replaces a newer one.
+	writeMu sync.Mutex
+	written int // the version last written to path
+	dirty   chan struct{}
+	done    chan struct{} // closed by Close to stop writeLoop
+	stopped chan struct{} // closed when writeLoop returns
+}
+
+// NewHARLog returns a HARLog. If path is not empty, the log is written to the
+// file at path after entries are added, by a background goroutine. Bursts of
+// entries are written together; call Flush to write the file immediately, and
+// Close to stop the goroutine.
+func NewHARLog(path string) *HARLog {
+	h := &HARLog{path: path}
+	if path != "" {
+		h.dirty = make(chan struct{}, 1)
+		h.done = make(chan struct{})
+		h.stopped = make(chan struct{})
+		go h.writeLoop()
+	}
+	return h
+}
+
+// WriteTo writes the log to w as a HAR 1.2 document.
+func (h *HARLog) WriteTo(w io.Writer) (int64, error) {
+	b, err := h.marshal()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// ServeHTTP serves the log as a downloadable HAR file.
+func (h *HARLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="traffic.har"`)
+	h.WriteTo(w)
+}
+
+// Reset removes all entries from the log.
+func (h *HARLog) Reset() {
+	h.mu.Lock()
+	h.entries = nil
+	h.next = 0
+	h.version++
+	h.mu.Unlock()
+	h.changed()
+}
+
+func (h *HARLog) marshal() ([]byte, error) {
+	b, _, err := h.snapshot()
+	return b, err
+}
+
+// snapshot returns the log as a HAR document, and its version.
+func (h *HARLog) snapshot() ([]byte, int, error) {
+	h.mu.Lock()
+	entries := make([]harEntry, 0, len(h.entries))
+	entries = append(entries, h.entries[h.next:]...)
+	entries = append(entries, h.entries[:h.next]...)
+	version := h.version
+	h.mu.Unlock()
+	b, err := json.MarshalIndent(harFile{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "github.com/kevinburke/handlers", Version: Version},
+		Entries: entries,
+	}}, "", "  ")
+	return b, version, err
+}
+
+func (h *HARLog) add(ex *debugExchange) {
+	limit := h.MaxEntries
+	if limit == 0 {
+		limit = DefaultHARMaxEntries
+	}
+	e := newHAREntry(ex)
+	h.mu.Lock()
+	if limit < 0 || len(h.entries) < limit {
+		h.entries = append(h.entries, e)
+	} else {
+		h.entries[h.next] = e
+		h.next = (h.next + 1) % len(h.entries)
+	}
+	h.version++
+	h.mu.Unlock()
+	h.changed()
+}
+
+// changed asks the background writer to write the file.
+func (h *HARLog) changed() {
+	if h.dirty == nil {
+		return
+	}
+	select {
+	case h.dirty <- struct{}{}:
+	default:
+		// A write is already pending, and will include this change.
+	}
+}
+
+func (h *HARLog) writeLoop() {
+	defer close(h.stopped)
+	for {
+		select {
+		case <-h.dirty:
+			if err := h.Flush(); err != nil {
+				Logger.Error("could not write HAR file", "path", h.path, "err", err)
+			}
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// Close stops the goroutine that writes the log file, and writes any entries
+// that haven't been written yet. Entries added after Close are kept in memory,
+// and only written to the file by Flush.
+func (h *HARLog) Close() error {
+	if h.path == "" {
+		return nil
+	}
+	h.mu.Lock()
+	closed := h.closed
+	h.closed = true
+	h.mu.Unlock()
+	if !closed {
+		close(h.done)
+		<-h.stopped
+	}
+	return h.Flush()
+}
+
+// Flush writes the log to the file passed to NewHARLog, if it has changed
+// since it was last written. It is a no-op if the HARLog has no file.
+func (h *HARLog) Flush() error {
+	if h.path == "" {
+		return nil
+	}
+	h.writeMu.Lock()
+	defer h.writeMu.Unlock()
+	b, version, err := h.snapshot()
+	if err != nil || version == h.written {
+		return err
+	}
+	// Write to a temporary file and rename it, so readers never see
+	// a partially written log.
+	tmp, err := os.CreateTemp(filepath.Dir(h.path), ".har-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), h.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	h.written = version
+	return nil
+}
+
+// The har* types implement the subset of the HAR 1.2 spec that we can fill
+// in: http://www.softwareishard.com/blog/har-12-spec/
+
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	RequestID       string      `json:"_requestId,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	out := make([]harNameValue, 0, len(h))
+	for name, vals := range h {
+		for _, val := range vals {
+			out = append(out, harNameValue{Name: name, Value: val})
+		}
+	}
+	return out
+}
+
+func newHAREntry(ex *debugExchange) harEntry {
+	ms := float64(ex.duration) / float64(time.Millisecond)
+	e := harEntry{
+		StartedDateTime: ex.start.Format(time.RFC3339Nano),
+		Time:            ms,
+		RequestID:       ex.requestID,
+		Timings:         harTimings{Wait: ms},
+		Request: harRequest{
+			Method:      ex.method,
+			URL:         ex.url,
+			HTTPVersion: ex.proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(ex.reqHeader),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    ex.reqBody.size,
+		},
+		Response: harResponse{
+			Status:      ex.status,
+			StatusText:  http.StatusText(ex.status),
+			HTTPVersion: ex.proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(ex.respHeader),
+			RedirectURL: ex.respHeader.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    ex.respBody.size,
+		},
+	}
+	if u, err := url.Parse(ex.url); err == nil {
+		for name, vals := range u.Query() {
+			for _, val := range vals {
+				e.Request.QueryString = append(e.Request.QueryString, harNameValue{Name: name, Value: val})
+			}
+		}
+	}
+	if len(ex.reqBody.data) > 0 || ex.reqBody.unread {
+		e.Request.PostData = &harPostData{
+			MimeType: ex.reqBody.contentType,
+			Text:     string(ex.reqBody.data),
+		}
+		if ex.reqBody.unread {
+			e.Request.PostData.Comment = "rest of body not read by handler"
+		}
+	}
+	rec := ex.respBody.record()
+	// content.size is the size of the decoded body.
+	e.Response.Content = harContent{
+		Size:     int64(len(ex.respBody.data)) + ex.respBody.omitted,
+		MimeType: ex.respBody.contentType,
+		Text:     rec.Body,
+	}
+	switch rec.BodyEncoding {
+	case "base64":
+		e.Response.Content.Encoding = "base64"
+	case "omitted":
+		e.Response.Content.Comment = "compressed body omitted"
+	}
+	if ex.respBody.omitted > 0 || ex.respBody.truncated {
+		e.Response.Content.Comment = "body truncated"
+	}
+	return e
+}
@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// redactHeader returns a copy of h with the values of the named headers
+// replaced with "[REDACTED]". If none of the headers are present, h is
+// returned unmodified.
+func redactHeader(h http.Header, names []string) http.Header {
+	var out http.Header
+	for _, name := range names {
+		key := http.CanonicalHeaderKey(name)
+		vals, ok := h[key]
+		if !ok {
+			continue
+		}
+		if out == nil {
+			out = h.Clone()
+		}
+		redactedVals := make([]string, len(vals))
+		for i := range vals {
+			redactedVals[i] = redacted
+		}
+		out[key] = redactedVals
+	}
+	if out == nil {
+		return h
+	}
+	return out
+}
+
+// fieldRedactor replaces the values of named fields in JSON and form encoded
+// bodies. A nil *fieldRedactor doesn't redact anything.
+type fieldRedactor struct {
+	names map[string]bool
+	// jsonKey matches a JSON object key that is one of the names, and the
+	// colon after it. It's used to redact bodies that aren't valid JSON,
+	// usually because they were truncated.
+	jsonKey *regexp.Regexp
+}
+
+func newFieldRedactor(names []string) *fieldRedactor {
+	if len(names) == 0 {
+		return nil
+	}
+	f := &fieldRedactor{names: make(map[string]bool, len(names))}
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		f.names[strings.ToLower(name)] = true
+		quoted[i] = regexp.QuoteMeta(name)
+	}
+	f.jsonKey = regexp.MustCompile(`(?i)"(?:` + strings.Join(quoted, "|") + `)"\s*:\s*`)
+	return f
+}
+
+// redactBody redacts fields in body, if contentType is a JSON or form media
+// type.
+func (f *fieldRedactor) redactBody(contentType string, body []byte) []byte {
+	if f == nil || len(body) == 0 {
+		return body
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		if json.Valid(body) {
+			if out, err := f.redactJSON(body); err == nil {
+				return out
+			}
+		}
+		return f.redactPartialJSON(body)
+	case mediaType == "application/x-www-form-urlencoded":
+		return []byte(f.redactForm(string(body)))
+	}
+	return body
+}
+
+// redactJSON replaces the values of named object members anywhere in body,
+// which must be valid JSON. The values are found by decoding body, but are
+// replaced in the raw text, so that the formatting is preserved.
+func (f *fieldRedactor) redactJSON(body []byte) ([]byte, error) {
+	var spans [][2]int64
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var walk func() error
+	walk = func() error {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'):
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				if name, _ := key.(string); !f.names[strings.ToLower(name)] {
+					if err := walk(); err != nil {
+						return err
+					}
+					continue
+				}
+				var v json.RawMessage
+				if err := dec.Decode(&v); err != nil {
+					return err
+				}
+				end := dec.InputOffset()
+				spans = append(spans, [2]int64{end - int64(len(v)), end})
+			}
+			_, err = dec.Token()
+		case json.Delim('['):
+			for dec.More() {
+				if err := walk(); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+		}
+		return err
+	}
+	if err := walk(); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(body))
+	var last int64
+	for _, span := range spans {
+		out = append(out, body[last:span[0]]...)
+		out = append(out, `"`+redacted+`"`...)
+		last = span[1]
+	}
+	return append(out, body[last:]...), nil
+}
+
+// redactPartialJSON redacts named object members in body without decoding
+// it, so that truncated bodies can still be redacted. A value that is cut
+// off is redacted up to the end of body.
+func (f *fieldRedactor) redactPartialJSON(body []byte) []byte {
+	out := make([]byte, 0, len(body))
+	last := 0
+	for _, m := range f.jsonKey.FindAllIndex(body, -1) {
+		if m[0] < last {
+			// The key is inside a value that has already been redacted.
+			continue
+		}
+		out = append(out, body[last:m[1]]...)
+		out = append(out, `"`+redacted+`"`...)
+		last = jsonValueEnd(body, m[1])
+	}
+	return append(out, body[last:]...)
+}
+
+// jsonValueEnd returns the offset just past the JSON value that starts at
+// body[i], or len(body) if the value is cut off. Arrays and objects end at
+// their matching bracket.
+func jsonValueEnd(body []byte, i int) int {
+	if i >= len(body) {
+		return i
+	}
+	switch body[i] {
+	case '"':
+		for j := i + 1; j < len(body); j++ {
+			switch body[j] {
+			case '\\':
+				j++
+			case '"':
+				return j + 1
+			}
+		}
+	case '[', '{':
+		depth, inString := 0, false
+		for j := i; j < len(body); j++ {
+			c := body[j]
+			if inString {
+				if c == '\\' {
+					j++
+				} else if c == '"' {
+					inString = false
+				}
+				continue
+			}
+			switch c {
+			case '"':
+				inString = true
+			case '[', '{':
+				depth++
+			case ']', '}':
+				if depth--; depth == 0 {
+					return j + 1
+				}
+			}
+		}
+	default:
+		j := i
+		for j < len(body) && !strings.ContainsRune(",}] \t\r\n", rune(body[j])) {
+			j++
+		}
+		return j
+	}
+	return len(body)
+}
+
+// redactRequestURI redacts fields in the query string of uri.
+func (f *fieldRedactor) redactRequestURI(uri string) string {
+	if f == nil {
+		return uri
+	}
+	path, query, ok := strings.Cut(uri, "?")
+	if !ok {
+		return uri
+	}
+	return path + "?" + f.redactForm(query)
+}
+
+// redactForm redacts fields in a URL encoded form, preserving the order of
+// the fields.
+func (f *fieldRedactor) redactForm(form string) string {
+	pairs := strings.Split(form, "&")
+	for i, pair := range pairs {
+		key, _, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		name, err := url.QueryUnescape(key)
+		if err != nil {
+			name = key
+		}
+		if f.names[strings.ToLower(name)] {
+			pairs[i] = key + "=" + url.QueryEscape(redacted)
+		}
+	}
+	return strings.Join(pairs, "&")
+}
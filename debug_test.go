@@ -0,0 +1,562 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDebugStreams(t *testing.T) {
+	t.Setenv("DEBUG_HTTP_TRAFFIC", "true")
+	out := new(bytes.Buffer)
+	w := httptest.NewRecorder()
+	h := DebugWithOptions(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "request body" {
+			t.Errorf("wrong request body: %q", body)
+		}
+		rw.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(rw, "data: one\n\n")
+		rw.(http.Flusher).Flush()
+		if !w.Flushed || w.Body.String() != "data: one\n\n" {
+			t.Errorf("response was not streamed to the client: %q", w.Body.String())
+		}
+		if out.Len() != 0 {
+			t.Errorf("dump written before handler returned")
+		}
+		io.WriteString(rw, "data: two\n\n")
+	}), &DebugOptions{Output: out, MaxBodyBytes: 15})
+	req := httptest.NewRequest("POST", "/events", strings.NewReader("request body"))
+	h.ServeHTTP(w, req)
+	if w.Body.String() != "data: one\n\ndata: two\n\n" {
+		t.Errorf("wrong response body: %q", w.Body.String())
+	}
+	dump := out.String()
+	for _, want := range []string{
+		"POST /events HTTP/1.1\r\n",
+		"request body",
+		"HTTP/1.1 200\r\n",
+		"Content-Type: text/event-stream\r\n",
+		"data: one\n\ndata",
+		"[7 more bytes omitted]",
+	} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("expected dump to contain %q, got %q", want, dump)
+		}
+	}
+}
+
+func TestDebugDisabled(t *testing.T) {
+	t.Setenv("DEBUG_HTTP_TRAFFIC", "")
+	t.Setenv("DEBUG_HTTP_SERVER_TRAFFIC", "")
+	out := new(bytes.Buffer)
+	w := httptest.NewRecorder()
+	DebugWriter(testServer(false), out).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if out.Len() != 0 {
+		t.Errorf("expected no output, got %q", out.String())
+	}
+	if w.Body.String() != msg {
+		t.Errorf("wrong body: %q", w.Body.String())
+	}
+}
+
+func TestDebugRedaction(t *testing.T) {
+	t.Setenv("DEBUG_HTTP_TRAFFIC", "true")
+	out := new(bytes.Buffer)
+	h := DebugWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret-session"})
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"user": "kevin", "Password": "hunter2", "token":"abc\"def", "pin": 1234}`)
+	}), &DebugOptions{
+		Output:       out,
+		RedactFields: []string{"password", "token", "pin"},
+		Scrub: func(dump []byte) []byte {
+			return bytes.ReplaceAll(dump, []byte("kevin"), []byte("k***n"))
+		},
+	})
+	req := httptest.NewRequest("POST", "/login?next=/home&token=querysecret", strings.NewReader("user=kevin&password=formsecret"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("kevin", "basicsecret")
+	req.Header.Set("Cookie", "session=cookiesecret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), "hunter2") {
+		t.Errorf("response body sent to the client was redacted: %q", w.Body.String())
+	}
+	if w.Header().Get("Set-Cookie") == "" || strings.Contains(w.Header().Get("Set-Cookie"), redacted) {
+		t.Errorf("response header sent to the client was redacted: %q", w.Header().Get("Set-Cookie"))
+	}
+	dump := out.String()
+	for _, secret := range []string{"basicsecret", "cookiesecret", "secret-session", "formsecret", "querysecret", "hunter2", `abc\"def`, "1234", "kevin"} {
+		if strings.Contains(dump, secret) {
+			t.Errorf("dump contains secret %q: %q", secret, dump)
+		}
+	}
+	for _, want := range []string{
+		"Authorization: [REDACTED]\r\n",
+		"Cookie: [REDACTED]\r\n",
+		"Set-Cookie: [REDACTED]\r\n",
+		"/login?next=/home&token=%5BREDACTED%5D",
+		"user=k***n&password=%5BREDACTED%5D",
+		`"Password": "[REDACTED]"`,
+		`"pin": "[REDACTED]"`,
+	} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("expected dump to contain %q, got %q", want, dump)
+		}
+	}
+}
+
+func TestRedactTruncatedJSON(t *testing.T) {
+	t.Parallel()
+	f := newFieldRedactor([]string{"password", "tokens"})
+	tests := []struct {
+		body, want string
+	}{
+		{`{"password": "hunt`, `{"password": "[REDACTED]"`},
+		{`{"tokens": ["aaa", "bbb"], "password": {"x": "y"}, "user": "ki`, `{"tokens": "[REDACTED]", "password": "[REDACTED]", "user": "ki`},
+		{`{"tokens": ["aaa", {"password": "b]b`, `{"tokens": "[REDACTED]"`},
+	}
+	for _, tt := range tests {
+		if got := string(f.redactBody("application/json; charset=utf-8", []byte(tt.body))); got != tt.want {
+			t.Errorf("redacting %q: got %q, want %q", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestRedactJSONValues(t *testing.T) {
+	t.Parallel()
+	f := newFieldRedactor([]string{"tokens", "password"})
+	tests := []struct {
+		body, want string
+	}{
+		{`{"tokens": ["aaa", "bbb"], "password": {"x": "y"}}`, `{"tokens": "[REDACTED]", "password": "[REDACTED]"}`},
+		{`[{"user": {"Password" :"a,b}"}}, {"note": "\"password\": 1"}]`, `[{"user": {"Password" :"[REDACTED]"}}, {"note": "\"password\": 1"}]`},
+		{`{"password": null, "n": 1}`, `{"password": "[REDACTED]", "n": 1}`},
+	}
+	for _, tt := range tests {
+		got := f.redactBody("application/json", []byte(tt.body))
+		if string(got) != tt.want {
+			t.Errorf("redacting %q: got %q, want %q", tt.body, got, tt.want)
+		}
+		if !json.Valid(got) {
+			t.Errorf("redacting %q: got invalid JSON %q", tt.body, got)
+		}
+	}
+}
+
+func TestDebugHeader(t *testing.T) {
+	t.Parallel()
+	secret := []byte("debug secret")
+	pred := DebugHeader(secret)
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{SignDebugTrace(secret, time.Now().Add(time.Hour)), true},
+		{SignDebugTrace(secret, time.Now().Add(-time.Hour)), false},
+		{SignDebugTrace([]byte("wrong secret"), time.Now().Add(time.Hour)), false},
+		{"12345", false},
+		{"99999999999.zz", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tt.header != "" {
+			req.Header.Set(DebugTraceHeader, tt.header)
+		}
+		if got := pred(req); got != tt.want {
+			t.Errorf("DebugHeader(%q): got %t, want %t", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestDebugHeaderEmptySecret(t *testing.T) {
+	t.Parallel()
+	defer func() {
+		if recover() == nil {
+			t.Error("expected DebugHeader to panic with an empty secret")
+		}
+	}()
+	DebugHeader(nil)
+}
+
+func TestDebugHeaderRedacted(t *testing.T) {
+	t.Parallel()
+	secret := []byte("debug secret")
+	out := new(bytes.Buffer)
+	h := DebugWithOptions(http.NotFoundHandler(), &DebugOptions{Output: out, Enabled: DebugHeader(secret)})
+	req := httptest.NewRequest("GET", "/", nil)
+	token := SignDebugTrace(secret, time.Now().Add(time.Hour))
+	req.Header.Set(DebugTraceHeader, token)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if out.Len() == 0 {
+		t.Fatal("expected a dump")
+	}
+	if strings.Contains(out.String(), token) || !strings.Contains(out.String(), DebugTraceHeader+": [REDACTED]\r\n") {
+		t.Errorf("expected the trace header to be redacted: %q", out.String())
+	}
+}
+
+func TestDebugPredicates(t *testing.T) {
+	t.Parallel()
+	req := httptest.NewRequest("GET", "/v1/users", nil)
+	if !DebugPathPrefix("/v2", "/v1/")(req) {
+		t.Error("expected DebugPathPrefix to match /v1/users")
+	}
+	if DebugPathPrefix("/v2")(req) {
+		t.Error("expected DebugPathPrefix not to match /v1/users")
+	}
+	if DebugSample(0)(req) {
+		t.Error("expected DebugSample(0) not to match")
+	}
+	if !DebugSample(1)(req) {
+		t.Error("expected DebugSample(1) to match")
+	}
+	if !DebugAny(DebugSample(0), DebugPathPrefix("/v1"))(req) {
+		t.Error("expected DebugAny to match")
+	}
+}
+
+func TestDebugSwitch(t *testing.T) {
+	t.Parallel()
+	var sw DebugSwitch
+	out := new(bytes.Buffer)
+	h := DebugWithOptions(testServer(false), &DebugOptions{Output: out, Enabled: sw.Enabled})
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if out.Len() != 0 {
+		t.Fatalf("expected no output with switch off, got %q", out.String())
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/debug", strings.NewReader("enabled=true"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	sw.ServeHTTP(w, req)
+	if w.Code != 200 || w.Body.String() != "{\"enabled\":true}\n" {
+		t.Fatalf("bad response from switch: %d %q", w.Code, w.Body.String())
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if !strings.Contains(out.String(), "GET / HTTP/1.1") {
+		t.Errorf("expected output with switch on, got %q", out.String())
+	}
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/debug", strings.NewReader("enabled=maybe"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	sw.ServeHTTP(w, req)
+	if w.Code != 400 {
+		t.Errorf("expected 400 for bad value, got %d", w.Code)
+	}
+	if !sw.Enabled(req) {
+		t.Error("bad request changed the switch")
+	}
+}
+
+func TestDebugJSON(t *testing.T) {
+	t.Parallel()
+	out := new(bytes.Buffer)
+	har := NewHARLog(filepath.Join(t.TempDir(), "traffic.har"))
+	h := Duration(UUID(DebugWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"id": 1}`)
+	}), &DebugOptions{
+		Output:  out,
+		Format:  DebugJSON,
+		Enabled: func(*http.Request) bool { return true },
+		HAR:     har,
+	})))
+	req := httptest.NewRequest("POST", "/v1/users?expand=true", strings.NewReader(`{"name": "kevin"}`))
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if bytes.Count(out.Bytes(), []byte("\n")) != 1 {
+		t.Errorf("expected a single line of JSON, got %q", out.String())
+	}
+	var rec debugRecord
+	if err := json.Unmarshal(out.Bytes(), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Request.Method != "POST" || rec.Request.URL != "http://example.com/v1/users?expand=true" || rec.Request.Proto != "HTTP/2.0" {
+		t.Errorf("bad request record: %+v", rec.Request)
+	}
+	if rec.Request.Body != `{"name": "kevin"}` {
+		t.Errorf("bad request body: %q", rec.Request.Body)
+	}
+	if rec.Response.Status != 201 || rec.Response.Body != `{"id": 1}` {
+		t.Errorf("bad response record: %+v", rec.Response)
+	}
+	if rec.RequestID == "" || rec.RequestID != req.Header.Get("X-Request-Id") && len(rec.RequestID) != 36 {
+		t.Errorf("bad request id: %q", rec.RequestID)
+	}
+	if rec.Time.IsZero() || rec.DurationMs < 0 {
+		t.Errorf("bad timings: %v %v", rec.Time, rec.DurationMs)
+	}
+
+	for _, src := range []func() ([]byte, error){
+		func() ([]byte, error) {
+			buf := new(bytes.Buffer)
+			_, err := har.WriteTo(buf)
+			return buf.Bytes(), err
+		},
+		func() ([]byte, error) {
+			if err := har.Flush(); err != nil {
+				return nil, err
+			}
+			return os.ReadFile(har.path)
+		},
+	} {
+		b, err := src()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var f harFile
+		if err := json.Unmarshal(b, &f); err != nil {
+			t.Fatal(err)
+		}
+		if f.Log.Version != "1.2" || len(f.Log.Entries) != 1 {
+			t.Fatalf("bad HAR log: %s", b)
+		}
+		e := f.Log.Entries[0]
+		if e.Request.Method != "POST" || e.Response.Status != 201 || e.Response.Content.Text != `{"id": 1}` {
+			t.Errorf("bad HAR entry: %+v", e)
+		}
+		if len(e.Request.QueryString) != 1 || e.Request.QueryString[0].Name != "expand" {
+			t.Errorf("bad HAR query string: %+v", e.Request.QueryString)
+		}
+	}
+}
+
+func TestDebugTextProto(t *testing.T) {
+	t.Parallel()
+	out := new(bytes.Buffer)
+	h := DebugWithOptions(testServer(false), &DebugOptions{Output: out, Enabled: func(*http.Request) bool { return true }})
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if !strings.Contains(out.String(), "HTTP/2.0 200\r\n") {
+		t.Errorf("expected response to be labeled HTTP/2.0, got %q", out.String())
+	}
+}
+
+func TestDebugDecodesGzip(t *testing.T) {
+	t.Parallel()
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(`{"name": "kevin"}`))
+	zw.Close()
+
+	out := new(bytes.Buffer)
+	h := DebugWithOptions(GZip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !bytes.Equal(body, gz.Bytes()) {
+			t.Errorf("request body was modified")
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Write(responseBody)
+	})), &DebugOptions{Output: out, Enabled: func(*http.Request) bool { return true }, MaxBodyBytes: -1})
+	req := httptest.NewRequest("POST", "/", bytes.NewReader(gz.Bytes()))
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected gzipped response")
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertResponseBody(t, zr)
+	dump := out.String()
+	if strings.Contains(dump, "[binary data omitted]") {
+		t.Errorf("expected dump to decode gzip bodies, got %q", dump)
+	}
+	if !strings.Contains(dump, `{"name": "kevin"}`) {
+		t.Errorf("expected dump to contain decoded request body, got %q", dump)
+	}
+	if !strings.Contains(dump, string(responseBody)) {
+		t.Errorf("expected dump to contain decoded response body")
+	}
+}
+
+func TestDebugDecodeLimit(t *testing.T) {
+	t.Parallel()
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(responseBody)
+	zw.Close()
+	d := &debugger{maxBody: 100}
+	header := http.Header{"Content-Encoding": {"gzip"}}
+	c := &cappedBuffer{max: 100}
+	c.Write(gz.Bytes())
+	body := d.body(header, c)
+	if body.binary || body.decoded != "gzip" {
+		t.Fatalf("expected body to be decoded: %+v", body)
+	}
+	if len(body.data) != 100 || !body.truncated {
+		t.Errorf("expected 100 truncated bytes, got %d (truncated %t)", len(body.data), body.truncated)
+	}
+	if body.size != int64(gz.Len()) {
+		t.Errorf("wrong size, got %d want %d", body.size, gz.Len())
+	}
+
+	c = &cappedBuffer{max: 100}
+	c.Write([]byte("not gzip"))
+	if body := d.body(header, c); !body.binary {
+		t.Errorf("expected invalid gzip data to be omitted")
+	}
+	header.Set("Content-Encoding", "br")
+	if body := d.body(header, c); !body.binary {
+		t.Errorf("expected unsupported encoding to be omitted")
+	}
+}
+
+// countingReader counts the bytes read from it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func TestDebugUnreadBody(t *testing.T) {
+	t.Parallel()
+	for _, max := range []int{0, -1} {
+		out := new(bytes.Buffer)
+		h := DebugWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			buf := make([]byte, 5)
+			io.ReadFull(r.Body, buf)
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		}), &DebugOptions{
+			Output:       out,
+			Format:       DebugJSON,
+			MaxBodyBytes: max,
+			Enabled:      func(*http.Request) bool { return true },
+		})
+		body := &countingReader{r: strings.NewReader("hello" + strings.Repeat("x", 1<<20))}
+		req := httptest.NewRequest("POST", "/upload", body)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		if body.n > 4096 {
+			t.Errorf("MaxBodyBytes %d: read %d bytes of a body the handler didn't want", max, body.n)
+		}
+		var rec debugRecord
+		if err := json.Unmarshal(out.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Request.Body != "hello" || !rec.Request.BodyUnread {
+			t.Errorf("MaxBodyBytes %d: got body %q, unread %t", max, rec.Request.Body, rec.Request.BodyUnread)
+		}
+	}
+
+	// A body read in full by its Content-Length is not marked unread.
+	out := new(bytes.Buffer)
+	h := DebugWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, r.ContentLength)
+		io.ReadFull(r.Body, buf)
+	}), &DebugOptions{Output: out, Enabled: func(*http.Request) bool { return true }})
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader("hello")))
+	if strings.Contains(out.String(), "not read by handler") {
+		t.Errorf("body read in full was marked unread: %q", out.String())
+	}
+}
+
+func TestHARLogConcurrent(t *testing.T) {
+	t.Parallel()
+	har := NewHARLog(filepath.Join(t.TempDir(), "traffic.har"))
+	h := DebugWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}), &DebugOptions{
+		Output:  io.Discard,
+		Enabled: func(*http.Request) bool { return true },
+		HAR:     har,
+	})
+	const n = 50
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/"+strconv.Itoa(i), nil))
+		}()
+	}
+	wg.Wait()
+	if err := har.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(har.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f harFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for _, e := range f.Log.Entries {
+		seen[e.Response.Content.Text] = true
+	}
+	if len(f.Log.Entries) != n || len(seen) != n {
+		t.Errorf("expected %d distinct entries in the HAR file, got %d (%d distinct)", n, len(f.Log.Entries), len(seen))
+	}
+}
+
+func TestHARLogMaxEntriesAndClose(t *testing.T) {
+	t.Parallel()
+	har := NewHARLog(filepath.Join(t.TempDir(), "traffic.har"))
+	har.MaxEntries = 3
+	h := DebugWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}), &DebugOptions{
+		Output:  io.Discard,
+		Enabled: func(*http.Request) bool { return true },
+		HAR:     har,
+	})
+	for i := range 5 {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/"+strconv.Itoa(i), nil))
+	}
+	if err := har.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-har.stopped:
+	default:
+		t.Error("expected Close to stop the writer goroutine")
+	}
+	if err := har.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+	b, err := os.ReadFile(har.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f harFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range f.Log.Entries {
+		got = append(got, e.Response.Content.Text)
+	}
+	if strings.Join(got, ",") != "/2,/3,/4" {
+		t.Errorf("expected the three most recent entries in order, got %q", got)
+	}
+}
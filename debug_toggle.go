@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/kevinburke/rest/v2"
+	"github.com/kevinburke/rest/v2/resterror"
+)
+
+// A DebugPredicate reports whether the Debug handlers should dump r.
+type DebugPredicate func(r *http.Request) bool
+
+// DebugEnv reports whether the DEBUG_HTTP_TRAFFIC or DEBUG_HTTP_SERVER_TRAFFIC
+// environment variable is set to "true". The environment is checked on every
+// request. DebugEnv is the default DebugPredicate.
+func DebugEnv(r *http.Request) bool {
+	return envFunc("DEBUG_HTTP_TRAFFIC") == "true" || envFunc("DEBUG_HTTP_SERVER_TRAFFIC") == "true"
+}
+
+// DebugAny returns a DebugPredicate that reports whether any of preds match
+// the request.
+func DebugAny(preds ...DebugPredicate) DebugPredicate {
+	return func(r *http.Request) bool {
+		for _, pred := range preds {
+			if pred(r) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// DebugPathPrefix returns a DebugPredicate that matches requests whose path
+// starts with one of prefixes.
+func DebugPathPrefix(prefixes ...string) DebugPredicate {
+	return func(r *http.Request) bool {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// DebugSample returns a DebugPredicate that matches a random fraction of
+// requests; rate should be between 0 (no requests) and 1 (every request).
+func DebugSample(rate float64) DebugPredicate {
+	return func(r *http.Request) bool {
+		return rand.Float64() < rate
+	}
+}
+
+// DebugTraceHeader is the request header checked by DebugHeader.
+const DebugTraceHeader = "X-Debug-Trace"
+
+// DebugHeader returns a DebugPredicate that matches requests with a valid,
+// unexpired X-Debug-Trace header signed with secret. Use SignDebugTrace to
+// generate a header value, so that an engineer can trace a single client's
+// traffic without turning on dumps for every request. The header is redacted
+// from dumps by default, since it can be replayed until it expires.
+//
+// DebugHeader panics if secret is empty.
+func DebugHeader(secret []byte) DebugPredicate {
+	if len(secret) == 0 {
+		panic("handlers: DebugHeader needs a secret")
+	}
+	return func(r *http.Request) bool {
+		val := r.Header.Get(DebugTraceHeader)
+		if val == "" {
+			return false
+		}
+		expiry, sig, ok := strings.Cut(val, ".")
+		if !ok {
+			return false
+		}
+		unix, err := strconv.ParseInt(expiry, 10, 64)
+		if err != nil || time.Now().Unix() > unix {
+			return false
+		}
+		got, err := hex.DecodeString(sig)
+		if err != nil {
+			return false
+		}
+		return hmac.Equal(got, debugTraceMAC(secret, expiry))
+	}
+}
+
+// SignDebugTrace returns a value for the X-Debug-Trace header that is valid
+// until expires, for use with DebugHeader.
+func SignDebugTrace(secret []byte, expires time.Time) string {
+	expiry := strconv.FormatInt(expires.Unix(), 10)
+	return expiry + "." + hex.EncodeToString(debugTraceMAC(secret, expiry))
+}
+
+func debugTraceMAC(secret []byte, expiry string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(expiry))
+	return mac.Sum(nil)
+}
+
+// A DebugSwitch turns debugging on or off at runtime. Use its Enabled method
+// as a DebugPredicate, and mount the DebugSwitch itself on an (authenticated)
+// admin route to let operators flip it:
+//
+//	var sw handlers.DebugSwitch
+//	h := handlers.DebugWithOptions(mux, &handlers.DebugOptions{Enabled: sw.Enabled})
+//	admin.Handle("/debug/http", handlers.BasicAuth(&sw, "admin", users))
+//
+// GET requests return the current state, and POST or PUT requests with an
+// "enabled" form value of "true" or "false" change it. The zero value is
+// a DebugSwitch that is turned off.
+type DebugSwitch struct {
+	on atomic.Bool
+}
+
+// Enabled reports whether the switch is on. It ignores r, and can be used as
+// a DebugPredicate.
+func (s *DebugSwitch) Enabled(r *http.Request) bool {
+	return s.on.Load()
+}
+
+// Set turns the switch on or off.
+func (s *DebugSwitch) Set(enabled bool) {
+	s.on.Store(enabled)
+}
+
+func (s *DebugSwitch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+	case "POST", "PUT":
+		enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+		if err != nil {
+			rest.BadRequest(w, r, &resterror.Error{
+				Title:    `Please provide an "enabled" parameter of "true" or "false"`,
+				ID:       "invalid_parameter",
+				Instance: r.URL.Path,
+			})
+			return
+		}
+		s.Set(enabled)
+	default:
+		rest.NotAllowed(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(struct {
+		Enabled bool `json:"enabled"`
+	}{s.on.Load()})
+}
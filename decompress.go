@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/kevinburke/rest/v2"
+	"github.com/kevinburke/rest/v2/resterror"
+)
+
+// A Decoding decompresses request bodies that were encoded with a single
+// content-coding, for example "gzip" or "zstd".
+type Decoding struct {
+	// Name is the content-coding token as it appears in the Content-Encoding
+	// header, for example "br".
+	Name string
+	// NewReader returns a ReadCloser that decompresses the data in r.
+	NewReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+// GzipDecoding decompresses request bodies with compress/gzip.
+var GzipDecoding = Decoding{
+	Name: "gzip",
+	NewReader: func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+}
+
+// DeflateDecoding decompresses request bodies with compress/zlib, as
+// specified in RFC 9110. Many clients send raw DEFLATE data without the zlib
+// wrapper instead, so DeflateDecoding falls back to compress/flate if the
+// body does not start with a zlib header.
+var DeflateDecoding = Decoding{
+	Name: "deflate",
+	NewReader: func(r io.Reader) (io.ReadCloser, error) {
+		br := bufio.NewReader(r)
+		header, err := br.Peek(2)
+		if err == nil && isZlibHeader(header) {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	},
+}
+
+// isZlibHeader reports whether b starts with a valid zlib header (RFC 1950
+// section 2.2) for the DEFLATE compression method.
+func isZlibHeader(b []byte) bool {
+	return b[0]&0x0f == 8 && (uint16(b[0])<<8|uint16(b[1]))%31 == 0
+}
+
+// DefaultDecompressMaxSize is the default value for
+// DecompressOptions.MaxSize.
+const DefaultDecompressMaxSize = 10 << 20
+
+// DecompressOptions configures the Decompress handler.
+type DecompressOptions struct {
+	// MaxSize is the largest decompressed request body, in bytes, that will
+	// be passed to the handler. Larger bodies are rejected with a 413
+	// Request Entity Too Large error, which protects against "zip bombs"
+	// that expand to many times their compressed size. If MaxSize is zero,
+	// DefaultDecompressMaxSize is used.
+	MaxSize int64
+
+	// Decodings lists the supported content-codings. If Decodings is empty,
+	// GzipDecoding and DeflateDecoding are used. To support Brotli or
+	// Zstandard, add a Decoding backed by a third party library.
+	Decodings []Decoding
+}
+
+// Decompress transparently decompresses request bodies sent with
+// a Content-Encoding header, like "Content-Encoding: gzip", before passing
+// them to h. The decompressed body replaces r.Body, the Content-Encoding
+// header is removed and the Content-Length is updated to match.
+//
+// Requests encoded with an unsupported content-coding get a 415 Unsupported
+// Media Type error, with an Accept-Encoding header listing the supported
+// codings (RFC 7694). Bodies that can't be decoded get a 400 Bad Request
+// error, and bodies larger than the configured MaxSize get a 413 Request
+// Entity Too Large error. opts may be nil.
+func Decompress(h http.Handler, opts *DecompressOptions) http.Handler {
+	maxSize := int64(DefaultDecompressMaxSize)
+	decodings := []Decoding{GzipDecoding, DeflateDecoding}
+	if opts != nil {
+		if opts.MaxSize > 0 {
+			maxSize = opts.MaxSize
+		}
+		if len(opts.Decodings) > 0 {
+			decodings = opts.Decodings
+		}
+	}
+	names := make([]string, len(decodings))
+	for i := range decodings {
+		names[i] = decodings[i].Name
+	}
+	acceptEncoding := strings.Join(names, ", ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Content-Encoding")
+		if header == "" || r.Body == nil || r.Body == http.NoBody {
+			h.ServeHTTP(w, r)
+			return
+		}
+		// Codings are listed in the order they were applied, so undo them
+		// in reverse.
+		codings := strings.Split(header, ",")
+		var body io.Reader = r.Body
+		for i := len(codings) - 1; i >= 0; i-- {
+			name := strings.ToLower(strings.TrimSpace(codings[i]))
+			if name == "identity" || name == "" {
+				continue
+			}
+			if name == "x-gzip" {
+				name = "gzip"
+			}
+			dec, ok := findDecoding(decodings, name)
+			if !ok {
+				w.Header().Set("Accept-Encoding", acceptEncoding)
+				writeError(w, r, http.StatusUnsupportedMediaType, &resterror.Error{
+					Title: fmt.Sprintf("Unsupported Content-Encoding %q. Please use one of: %s", name, acceptEncoding),
+					ID:    "unsupported_content_encoding",
+				})
+				return
+			}
+			rc, err := dec.NewReader(body)
+			if err != nil {
+				badEncoding(w, r, name, err)
+				return
+			}
+			defer rc.Close()
+			body = rc
+		}
+
+		// Read the whole body now so that we can reject it before the
+		// handler starts, instead of surfacing a read error halfway through.
+		buf := new(bytes.Buffer)
+		n, err := buf.ReadFrom(io.LimitReader(body, maxSize+1))
+		if err != nil {
+			badEncoding(w, r, header, err)
+			return
+		}
+		if n > maxSize {
+			writeError(w, r, http.StatusRequestEntityTooLarge, &resterror.Error{
+				Title: fmt.Sprintf("Decompressed request body is larger than the maximum of %d bytes", maxSize),
+				ID:    "request_entity_too_large",
+			})
+			return
+		}
+		r.Body.Close()
+		r2 := r.Clone(r.Context())
+		r2.Body = io.NopCloser(buf)
+		r2.ContentLength = n
+		r2.Header.Del("Content-Encoding")
+		r2.Header.Set("Content-Length", strconv.FormatInt(n, 10))
+		h.ServeHTTP(w, r2)
+	})
+}
+
+func findDecoding(decodings []Decoding, name string) (Decoding, bool) {
+	for i := range decodings {
+		if strings.EqualFold(decodings[i].Name, name) {
+			return decodings[i], true
+		}
+	}
+	return Decoding{}, false
+}
+
+func badEncoding(w http.ResponseWriter, r *http.Request, coding string, err error) {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		writeError(w, r, http.StatusRequestEntityTooLarge, &resterror.Error{
+			Title: fmt.Sprintf("Request body is larger than the maximum of %d bytes", maxErr.Limit),
+			ID:    "request_entity_too_large",
+		})
+		return
+	}
+	rest.BadRequest(w, r, &resterror.Error{
+		Title:    fmt.Sprintf("Could not decode request body with Content-Encoding %q: %v", coding, err),
+		ID:       "invalid_content_encoding",
+		Instance: r.URL.Path,
+	})
+}
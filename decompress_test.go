@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func echoBody(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if enc := r.Header.Get("Content-Encoding"); enc != "" {
+			t.Errorf("expected Content-Encoding to be removed, got %q", enc)
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.ContentLength != int64(len(body)) {
+			t.Errorf("wrong ContentLength, got %d want %d", r.ContentLength, len(body))
+		}
+		w.Write(body)
+	})
+}
+
+func TestDecompress(t *testing.T) {
+	t.Parallel()
+	var gz, zl, fl bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(responseBody)
+	gw.Close()
+	zw := zlib.NewWriter(&zl)
+	zw.Write(responseBody)
+	zw.Close()
+	fw, _ := flate.NewWriter(&fl, flate.DefaultCompression)
+	fw.Write(responseBody)
+	fw.Close()
+
+	tests := []struct {
+		encoding string
+		body     []byte
+	}{
+		{"gzip", gz.Bytes()},
+		{"x-gzip", gz.Bytes()},
+		{"deflate", zl.Bytes()},
+		{"deflate", fl.Bytes()},
+		{"identity", responseBody},
+		{"", responseBody},
+	}
+	h := Decompress(echoBody(t), nil)
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/", bytes.NewReader(tt.body))
+		if tt.encoding != "" {
+			req.Header.Set("Content-Encoding", tt.encoding)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Errorf("%q: expected 200, got %d: %s", tt.encoding, w.Code, w.Body.String())
+			continue
+		}
+		if !bytes.Equal(w.Body.Bytes(), responseBody) {
+			t.Errorf("%q: wrong body, got %d bytes want %d", tt.encoding, w.Body.Len(), len(responseBody))
+		}
+	}
+}
+
+func TestDecompressUnsupported(t *testing.T) {
+	t.Parallel()
+	h := Decompress(echoBody(t), nil)
+	req := httptest.NewRequest("POST", "/", strings.NewReader("data"))
+	req.Header.Set("Content-Encoding", "br")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected 415, got %d", w.Code)
+	}
+	if accept := w.Header().Get("Accept-Encoding"); accept != "gzip, deflate" {
+		t.Errorf("wrong Accept-Encoding header, got %q", accept)
+	}
+	if !strings.Contains(w.Body.String(), "unsupported_content_encoding") {
+		t.Errorf("bad error body: %s", w.Body.String())
+	}
+}
+
+func TestDecompressTooLarge(t *testing.T) {
+	t.Parallel()
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(bytes.Repeat([]byte{0}, 1<<20))
+	gw.Close()
+	h := Decompress(echoBody(t), &DecompressOptions{MaxSize: 1024})
+	req := httptest.NewRequest("POST", "/", bytes.NewReader(gz.Bytes()))
+	req.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413, got %d", w.Code)
+	}
+}
+
+func TestDecompressInvalid(t *testing.T) {
+	t.Parallel()
+	h := Decompress(echoBody(t), nil)
+	req := httptest.NewRequest("POST", "/", strings.NewReader("not gzip data"))
+	req.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+}
@@ -26,6 +26,11 @@ func ExampleRegexp() {
 
 	h := new(handlers.Regexp)
 	h.HandleFunc(route, []string{"GET", "POST"}, func(w http.ResponseWriter, r *http.Request) {
-		io.WriteString(w, "Hello World!")
+		io.WriteString(w, "Hello "+handlers.Param(r, "JobName")+"!")
 	})
+	req := httptest.NewRequest("GET", "/v1/jobs/build", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	fmt.Println(w.Body.String())
+	// Output: Hello build!
 }
@@ -6,6 +6,7 @@ require (
 	github.com/gofrs/uuid/v5 v5.4.0
 	github.com/inconshreveable/log15/v3 v3.2.1
 	github.com/kevinburke/rest/v2 v2.15.0
+	golang.org/x/crypto v0.55.0
 	golang.org/x/term v0.45.0
 )
 
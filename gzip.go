@@ -9,48 +9,196 @@ import (
 	"compress/gzip"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 type compressResponseWriter struct {
-	io.Writer
-	http.ResponseWriter
-	http.Hijacker
-	http.Flusher
+	baseWriter
+
+	enc      Encoding
+	level    int
+	minSize  int
+	types    []string
+	excluded []string
+
+	// status is the code passed to WriteHeader, or 0 if WriteHeader has not
+	// been called.
+	status int
+	// buf holds the start of the response body until we decide whether to
+	// compress it.
+	buf     []byte
+	decided bool
+	// writer compresses the response body; nil if the response is passed
+	// through unmodified.
+	writer io.WriteCloser
 }
 
 func (w *compressResponseWriter) WriteHeader(c int) {
-	w.ResponseWriter.Header().Del("Content-Length")
-	w.ResponseWriter.WriteHeader(c)
+	if c >= 100 && c <= 199 {
+		// Informational responses don't have a body, and may be followed
+		// by another call to WriteHeader.
+		w.w.WriteHeader(c)
+		return
+	}
+	if w.decided || w.status != 0 {
+		return
+	}
+	w.status = c
+	if !bodyAllowedForStatus(c) || w.Header().Get("Content-Encoding") != "" {
+		// Nothing to compress, or the handler already encoded the body
+		// (for example, by serving a precompressed file).
+		w.decide(false)
+		return
+	}
+	if cl, err := strconv.Atoi(w.Header().Get("Content-Length")); err == nil && cl < w.minSize {
+		w.decide(false)
+	}
 }
 
-func (w *compressResponseWriter) Header() http.Header {
-	return w.ResponseWriter.Header()
+// bodyAllowedForStatus reports whether a response with the given status code
+// may have a body. See RFC 9110 sections 15.3.5 and 15.4.5.
+func bodyAllowedForStatus(status int) bool {
+	switch {
+	case status >= 100 && status <= 199:
+		return false
+	case status == http.StatusNoContent:
+		return false
+	case status == http.StatusNotModified:
+		return false
+	}
+	return true
 }
 
 func (w *compressResponseWriter) Write(b []byte) (int, error) {
-	h := w.ResponseWriter.Header()
-	if h.Get("Content-Type") == "" {
-		h.Set("Content-Type", http.DetectContentType(b))
+	if !w.decided {
+		if w.status == 0 {
+			w.WriteHeader(http.StatusOK)
+		}
+	}
+	if w.decided {
+		if w.writer != nil {
+			return w.writer.Write(b)
+		}
+		return w.w.Write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= w.minSize {
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// decide determines whether to compress the response, writes the response
+// headers and flushes any buffered data. If large is false, the body is known
+// to be smaller than minSize and will not be compressed.
+func (w *compressResponseWriter) decide(large bool) error {
+	w.decided = true
+	h := w.Header()
+	if h.Get("Content-Type") == "" && len(w.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+	if large && h.Get("Content-Encoding") == "" && w.compressible(h.Get("Content-Type")) {
+		cw, err := w.enc.NewWriter(w.w, w.level)
+		if err == nil {
+			w.writer = cw
+			h.Set("Content-Encoding", w.enc.Name)
+			h.Del("Content-Length")
+		}
+	}
+	if w.status != 0 {
+		w.w.WriteHeader(w.status)
+	}
+	if len(w.buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.writer != nil {
+		_, err = w.writer.Write(w.buf)
+	} else {
+		_, err = w.w.Write(w.buf)
+	}
+	w.buf = nil
+	return err
+}
+
+// compressible reports whether a response with the given Content-Type should
+// be compressed.
+func (w *compressResponseWriter) compressible(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if len(w.types) > 0 && !matchMediaType(w.types, mediaType) {
+		return false
+	}
+	return !matchMediaType(w.excluded, mediaType)
+}
+
+// matchMediaType reports whether mediaType matches any of patterns. Patterns
+// are either full media types like "application/zip" or wildcards like
+// "image/*".
+func matchMediaType(patterns []string, mediaType string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if pattern == mediaType {
+			return true
+		}
 	}
-	h.Del("Content-Length")
+	return false
+}
 
-	return w.Writer.Write(b)
+// Close writes any buffered data and finishes the compressed stream, if any.
+func (w *compressResponseWriter) Close() error {
+	if !w.decided {
+		if w.status == 0 && len(w.buf) == 0 {
+			// The handler never wrote anything (or hijacked the
+			// connection); let net/http take care of the response.
+			return nil
+		}
+		if err := w.decide(len(w.buf) >= w.minSize); err != nil {
+			return err
+		}
+	}
+	if w.writer != nil {
+		return w.writer.Close()
+	}
+	return nil
 }
 
 type flusher interface {
 	Flush() error
 }
 
+// Flush sends any buffered data to the client. Flushing before MinSize bytes
+// have been written commits to compressing the response, since the final
+// size cannot be known.
 func (w *compressResponseWriter) Flush() {
+	if !w.decided {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		w.decide(true)
+	}
 	// Flush compressed data if compressor supports it.
-	if f, ok := w.Writer.(flusher); ok {
+	if f, ok := w.writer.(flusher); ok {
 		f.Flush()
 	}
 	// Flush HTTP response.
-	if w.Flusher != nil {
-		w.Flusher.Flush()
+	w.baseWriter.Flush()
+}
+
+// ReadFrom implements the io.ReaderFrom interface.
+func (w *compressResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.decided && w.writer == nil {
+		return readFrom(w.w, w.w, r)
 	}
+	return io.Copy(writerOnly{w}, r)
 }
 
 // GZip gzip compresses HTTP responses for clients that support it via the
@@ -62,77 +210,322 @@ func (w *compressResponseWriter) Flush() {
 // with unencrypted traffic, static pages, or pages that only contain public
 // data.
 func GZip(h http.Handler) http.Handler {
-	return compressHandlerLevel(h, gzip.DefaultCompression)
+	return Compress(h, nil)
+}
+
+// An Encoding compresses response bodies using a single content-coding, for
+// example "gzip" or "br".
+type Encoding struct {
+	// Name is the content-coding token as it appears in the Accept-Encoding
+	// and Content-Encoding headers, for example "zstd".
+	Name string
+	// NewWriter returns a WriteCloser that compresses data written to it and
+	// writes the result to w. level is the Level from CompressOptions, or
+	// gzip.DefaultCompression (-1) if no level was specified; encoders that
+	// do not understand the level should use their own default.
+	NewWriter func(w io.Writer, level int) (io.WriteCloser, error)
 }
 
-// compressHandlerLevel gzip compresses HTTP responses with specified compression level
-// for clients that support it via the 'Accept-Encoding' header.
+// GzipEncoding compresses responses with compress/gzip. Writers are reused
+// across responses.
+var GzipEncoding = Encoding{
+	Name: "gzip",
+	NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+		return getPooledWriter(gzipPools[:], w, level, func(w io.Writer, level int) (resetWriter, error) {
+			return gzip.NewWriterLevel(w, level)
+		})
+	},
+}
+
+// DeflateEncoding compresses responses with compress/flate. Writers are reused
+// across responses.
+var DeflateEncoding = Encoding{
+	Name: "deflate",
+	NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+		return getPooledWriter(flatePools[:], w, level, func(w io.Writer, level int) (resetWriter, error) {
+			return flate.NewWriter(w, level)
+		})
+	},
+}
+
+// resetWriter is implemented by *gzip.Writer and *flate.Writer.
+type resetWriter interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// Allocating a gzip or flate writer is expensive (hundreds of kilobytes for
+// the compression tables), so keep one pool of writers per compression level,
+// indexed by level - gzip.HuffmanOnly.
+var (
+	gzipPools  [gzip.BestCompression - gzip.HuffmanOnly + 1]sync.Pool
+	flatePools [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+)
+
+// getPooledWriter returns a writer from the pool for level, or creates one
+// with newWriter if the pool is empty. Closing the returned writer returns it
+// to the pool.
+func getPooledWriter(pools []sync.Pool, w io.Writer, level int, newWriter func(io.Writer, int) (resetWriter, error)) (io.WriteCloser, error) {
+	idx := level - gzip.HuffmanOnly
+	if idx < 0 || idx >= len(pools) {
+		// invalid level; let the constructor return an error.
+		return newWriter(w, level)
+	}
+	pool := &pools[idx]
+	if rw, ok := pool.Get().(resetWriter); ok {
+		rw.Reset(w)
+		return &pooledWriter{resetWriter: rw, pool: pool}, nil
+	}
+	rw, err := newWriter(w, level)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledWriter{resetWriter: rw, pool: pool}, nil
+}
+
+type pooledWriter struct {
+	resetWriter
+	pool *sync.Pool
+}
+
+// Close flushes any unwritten data and returns the writer to its pool. The
+// pooledWriter must not be used after Close.
+func (p *pooledWriter) Close() error {
+	if p.resetWriter == nil {
+		return nil
+	}
+	err := p.resetWriter.Close()
+	// Don't hold on to the ResponseWriter while in the pool.
+	p.resetWriter.Reset(io.Discard)
+	p.pool.Put(p.resetWriter)
+	p.resetWriter = nil
+	return err
+}
+
+// CompressOptions configures the Compress handler.
+type CompressOptions struct {
+	// Level is the compression level passed to each Encoding. For gzip and
+	// deflate it should be gzip.DefaultCompression or an integer between
+	// gzip.BestSpeed and gzip.BestCompression inclusive. If Level is zero or
+	// out of range, gzip.DefaultCompression is used.
+	Level int
+
+	// Encodings lists the supported encodings in order of preference. When
+	// a client accepts several encodings with the same q-value, the one that
+	// appears first in this list is used. If Encodings is empty,
+	// GzipEncoding and DeflateEncoding are used.
+	//
+	// To support Brotli or Zstandard, add an Encoding backed by a third party
+	// library, for example:
+	//
+	//	zstdEncoding := handlers.Encoding{
+	//		Name: "zstd",
+	//		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+	//			return zstd.NewWriter(w)
+	//		},
+	//	}
+	Encodings []Encoding
+
+	// MinSize is the smallest response body, in bytes, that will be
+	// compressed. Responses are buffered in memory until MinSize bytes have
+	// been written, and smaller responses are sent unmodified with their
+	// Content-Length intact. If MinSize is zero, DefaultCompressMinSize is
+	// used; set a negative value to compress every response.
+	MinSize int
+
+	// ContentTypes, if not empty, lists the only media types that will be
+	// compressed. Entries may be full media types like "application/json" or
+	// wildcards like "text/*".
+	ContentTypes []string
+
+	// ExcludedContentTypes lists media types that will never be compressed,
+	// in the same format as ContentTypes. If ExcludedContentTypes is nil,
+	// DefaultExcludedContentTypes is used; set it to an empty slice to
+	// compress every media type.
+	ExcludedContentTypes []string
+}
+
+// DefaultCompressMinSize is the default value for CompressOptions.MinSize.
+// Compressing bodies smaller than a single TCP packet rarely saves bandwidth.
+const DefaultCompressMinSize = 1024
+
+// DefaultExcludedContentTypes lists media types that are already compressed,
+// and are not compressed by default.
+var DefaultExcludedContentTypes = []string{
+	"image/png",
+	"image/jpeg",
+	"image/gif",
+	"image/webp",
+	"image/avif",
+	"video/*",
+	"audio/*",
+	"font/woff",
+	"font/woff2",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/zstd",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+}
+
+// Compress compresses HTTP responses for clients that support it via the
+// 'Accept-Encoding' header, using the encodings configured in opts. q-values
+// in the Accept-Encoding header are honored, so "gzip;q=0" disables gzip and
+// "identity" may be preferred over any compression. opts may be nil.
 //
-// The compression level should be gzip.DefaultCompression, gzip.NoCompression,
-// or any integer value between gzip.BestSpeed and gzip.BestCompression inclusive.
-// gzip.DefaultCompression is used in case of invalid compression level.
-func compressHandlerLevel(h http.Handler, level int) http.Handler {
-	if level < gzip.DefaultCompression || level > gzip.BestCompression {
-		level = gzip.DefaultCompression
+// The same CRIME/BEAST caveats described on GZip apply to Compress.
+func Compress(h http.Handler, opts *CompressOptions) http.Handler {
+	c := compressor{
+		level:     gzip.DefaultCompression,
+		encodings: []Encoding{GzipEncoding, DeflateEncoding},
+		minSize:   DefaultCompressMinSize,
+		excluded:  DefaultExcludedContentTypes,
+	}
+	if opts != nil {
+		if opts.Level != 0 && opts.Level >= gzip.DefaultCompression && opts.Level <= gzip.BestCompression {
+			c.level = opts.Level
+		}
+		if len(opts.Encodings) > 0 {
+			c.encodings = opts.Encodings
+		}
+		if opts.MinSize < 0 {
+			c.minSize = 0
+		} else if opts.MinSize > 0 {
+			c.minSize = opts.MinSize
+		}
+		c.types = opts.ContentTypes
+		if opts.ExcludedContentTypes != nil {
+			c.excluded = opts.ExcludedContentTypes
+		}
+	}
+	return compressHandlerLevel(h, c)
+}
+
+type compressor struct {
+	level     int
+	encodings []Encoding
+	minSize   int
+	types     []string
+	excluded  []string
+}
+
+// compressHandlerLevel compresses HTTP responses with the configured
+// compression level for clients that support one of c.encodings via the
+// 'Accept-Encoding' header.
+func compressHandlerLevel(h http.Handler, c compressor) http.Handler {
+	names := make([]string, len(c.encodings))
+	for i := range c.encodings {
+		names[i] = c.encodings[i].Name
 	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-	L:
-		for enc := range strings.SplitSeq(r.Header.Get("Accept-Encoding"), ",") {
-			switch strings.TrimSpace(enc) {
-			case "gzip":
-				w.Header().Set("Content-Encoding", "gzip")
-				w.Header().Add("Vary", "Accept-Encoding")
-
-				gw, _ := gzip.NewWriterLevel(w, level)
-				defer gw.Close()
-
-				h, hok := w.(http.Hijacker)
-				if !hok { /* w is not Hijacker... oh well... */
-					h = nil
-				}
-
-				f, fok := w.(http.Flusher)
-				if !fok {
-					f = nil
-				}
-
-				w = &compressResponseWriter{
-					Writer:         gw,
-					ResponseWriter: w,
-					Hijacker:       h,
-					Flusher:        f,
-				}
-
-				break L
-			case "deflate":
-				w.Header().Set("Content-Encoding", "deflate")
-				w.Header().Add("Vary", "Accept-Encoding")
-
-				fw, _ := flate.NewWriter(w, level)
-				defer fw.Close()
-
-				h, hok := w.(http.Hijacker)
-				if !hok { /* w is not Hijacker... oh well... */
-					h = nil
-				}
-
-				f, fok := w.(http.Flusher)
-				if !fok {
-					f = nil
-				}
-
-				w = &compressResponseWriter{
-					Writer:         fw,
-					ResponseWriter: w,
-					Hijacker:       h,
-					Flusher:        f,
-				}
-
-				break L
+		w.Header().Add("Vary", "Accept-Encoding")
+		// HEAD responses don't have a body, so there's no way to compress
+		// them.
+		name := ""
+		if r.Method != "HEAD" {
+			name = negotiateEncoding(r.Header.Get("Accept-Encoding"), names)
+		}
+		if name == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		var enc Encoding
+		for i := range c.encodings {
+			if c.encodings[i].Name == name {
+				enc = c.encodings[i]
+				break
 			}
 		}
 
-		h.ServeHTTP(w, r)
+		cw := &compressResponseWriter{
+			baseWriter: baseWriter{w: w},
+			enc:        enc,
+			level:      c.level,
+			minSize:    c.minSize,
+			types:      c.types,
+			excluded:   c.excluded,
+		}
+		defer cw.Close()
+		h.ServeHTTP(wrapWriter(w, cw), r)
 	})
 }
+
+// acceptEncoding is a single entry in an Accept-Encoding header.
+type acceptEncoding struct {
+	coding string
+	q      float64
+}
+
+// parseAcceptEncoding parses the value of an Accept-Encoding header. Entries
+// with an invalid q-value are ignored. Codings are lower cased, and "x-gzip"
+// is treated as an alias for "gzip" (RFC 9110 section 8.4.1.3).
+func parseAcceptEncoding(header string) []acceptEncoding {
+	var accepted []acceptEncoding
+	for part := range strings.SplitSeq(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		if coding == "x-gzip" {
+			coding = "gzip"
+		}
+		q := 1.0
+		valid := true
+		for param := range strings.SplitSeq(params, ";") {
+			key, val, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if !ok || !strings.EqualFold(strings.TrimSpace(key), "q") {
+				continue
+			}
+			f, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+			if err != nil || f < 0 || f > 1 {
+				valid = false
+				break
+			}
+			q = f
+		}
+		if valid {
+			accepted = append(accepted, acceptEncoding{coding: coding, q: q})
+		}
+	}
+	return accepted
+}
+
+// negotiateEncoding returns the coding in available (listed in order of
+// server preference) that the client prefers according to the Accept-Encoding
+// header, or the empty string if the response should not be encoded.
+func negotiateEncoding(header string, available []string) string {
+	accepted := parseAcceptEncoding(header)
+	if len(accepted) == 0 {
+		return ""
+	}
+	qvalue := func(coding string) (float64, bool) {
+		wildcard, hasWildcard := 0.0, false
+		for _, a := range accepted {
+			if a.coding == coding {
+				return a.q, true
+			}
+			if a.coding == "*" {
+				wildcard, hasWildcard = a.q, true
+			}
+		}
+		return wildcard, hasWildcard
+	}
+	best, bestQ := "", 0.0
+	for _, coding := range available {
+		if q, ok := qvalue(strings.ToLower(coding)); ok && q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	// identity is always acceptable unless explicitly excluded, but only
+	// takes priority over a coding if the client asked for it by name.
+	for _, a := range accepted {
+		if a.coding == "identity" && a.q > bestQ {
+			return ""
+		}
+	}
+	return best
+}
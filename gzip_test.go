@@ -157,9 +157,19 @@ func TestCompressHandlerPreserveInterfaces(t *testing.T) {
 	)
 	var h http.Handler = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 		comp := r.Header.Get("Accept-Encoding")
-		if _, ok := rw.(*compressResponseWriter); !ok {
+		u, ok := rw.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
 			t.Fatalf("ResponseWriter wasn't wrapped by compressResponseWriter, got %T type", rw)
 		}
+		if _, ok := u.Unwrap().(fullyFeaturedResponseWriter); !ok {
+			t.Errorf("Unwrap returned wrong ResponseWriter: %T", u.Unwrap())
+		}
+		if _, ok := rw.(http.Pusher); ok {
+			t.Errorf("ResponseWriter gained http.Pusher interface for %q", comp)
+		}
+		if _, ok := rw.(io.ReaderFrom); ok {
+			t.Errorf("ResponseWriter gained io.ReaderFrom interface for %q", comp)
+		}
 		if _, ok := rw.(http.Flusher); !ok {
 			t.Errorf("ResponseWriter lost http.Flusher interface for %q", comp)
 		}
@@ -178,3 +188,309 @@ func TestCompressHandlerPreserveInterfaces(t *testing.T) {
 	r.Header.Set("Accept-Encoding", "deflate")
 	h.ServeHTTP(rw, r)
 }
+
+func TestNegotiateEncoding(t *testing.T) {
+	t.Parallel()
+	available := []string{"gzip", "deflate"}
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"gzip, deflate ", "gzip"},
+		{"deflate, gzip", "gzip"},
+		{"GZIP", "gzip"},
+		{"x-gzip", "gzip"},
+		{"gzip;q=0", ""},
+		{"gzip;q=0, deflate", "deflate"},
+		{"gzip;q=0.5, deflate;q=0.8", "deflate"},
+		{"gzip; q=0.8, deflate; q=0.8", "gzip"},
+		{"*", "gzip"},
+		{"*;q=0", ""},
+		{"gzip;q=0, *", "deflate"},
+		{"identity", ""},
+		{"gzip;q=0.5, identity", ""},
+		{"gzip, identity;q=0.5", "gzip"},
+		{"gzip;q=2", ""},
+		{"gzip;q=bogus, deflate", "deflate"},
+		{"br, zstd", ""},
+	}
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.header, available); got != tt.want {
+			t.Errorf("negotiateEncoding(%q): got %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestCompressHandlerGzipQZero(t *testing.T) {
+	t.Parallel()
+	w := httptest.NewRecorder()
+	compressedRequest(w, "gzip;q=0")
+	if enc := w.Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("wrong content encoding, got %q want %q", enc, "")
+	}
+	if w.Body.Len() != 1024*9 {
+		t.Errorf("wrong len, got %d want %d", w.Body.Len(), 1024*9)
+	}
+}
+
+type upperWriter struct {
+	w io.Writer
+}
+
+func (u upperWriter) Write(b []byte) (int, error) {
+	return u.w.Write(bytes.ToUpper(b))
+}
+
+func (u upperWriter) Close() error { return nil }
+
+func TestCompressCustomEncoding(t *testing.T) {
+	t.Parallel()
+	upper := Encoding{
+		Name: "upper",
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return upperWriter{w}, nil
+		},
+	}
+	h := Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello world")
+	}), &CompressOptions{Encodings: []Encoding{upper, GzipEncoding}, MinSize: -1})
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip;q=0.5, upper")
+	h.ServeHTTP(w, r)
+	if enc := w.Header().Get("Content-Encoding"); enc != "upper" {
+		t.Errorf("wrong content encoding, got %q want %q", enc, "upper")
+	}
+	if body := w.Body.String(); body != "HELLO WORLD" {
+		t.Errorf("wrong body, got %q", body)
+	}
+	if vary := w.Header().Get("Vary"); vary != "Accept-Encoding" {
+		t.Errorf("wrong Vary header, got %q", vary)
+	}
+}
+
+func TestCompressSmallBody(t *testing.T) {
+	t.Parallel()
+	h := GZip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", "20")
+		io.WriteString(w, `{"error": "invalid"}`)
+	}))
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	h.ServeHTTP(w, r)
+	if enc := w.Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("wrong content encoding, got %q want %q", enc, "")
+	}
+	if l := w.Header().Get("Content-Length"); l != "20" {
+		t.Errorf("wrong content-length, got %q want %q", l, "20")
+	}
+	if body := w.Body.String(); body != `{"error": "invalid"}` {
+		t.Errorf("wrong body, got %q", body)
+	}
+}
+
+func TestCompressSmallBodyMultipleWrites(t *testing.T) {
+	t.Parallel()
+	h := Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		for range 10 {
+			io.WriteString(w, "Gorilla!\n")
+		}
+	}), &CompressOptions{MinSize: 50})
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated {
+		t.Errorf("wrong status code, got %d want %d", w.Code, http.StatusCreated)
+	}
+	if enc := w.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Errorf("wrong content encoding, got %q want %q", enc, "gzip")
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(w.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("create gzip reader: %v", err)
+	}
+	defer zr.Close()
+	body, _ := io.ReadAll(zr)
+	if string(body) != string(bytes.Repeat([]byte("Gorilla!\n"), 10)) {
+		t.Errorf("wrong body, got %q", body)
+	}
+}
+
+func TestCompressContentTypes(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		contentType string
+		opts        *CompressOptions
+		want        string
+	}{
+		{"text/plain; charset=utf-8", nil, "gzip"},
+		{"image/png", nil, ""},
+		{"image/svg+xml", nil, "gzip"},
+		{"video/mp4", nil, ""},
+		{"application/zip", nil, ""},
+		{"image/png", &CompressOptions{ExcludedContentTypes: []string{}}, "gzip"},
+		{"text/html", &CompressOptions{ContentTypes: []string{"application/json"}}, ""},
+		{"application/json", &CompressOptions{ContentTypes: []string{"application/json", "text/*"}}, "gzip"},
+		{"text/css", &CompressOptions{ContentTypes: []string{"application/json", "text/*"}}, "gzip"},
+		{"text/css", &CompressOptions{ExcludedContentTypes: []string{"TEXT/*"}}, ""},
+	}
+	for _, tt := range tests {
+		h := Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", tt.contentType)
+			w.Header().Set("Content-Length", strconv.Itoa(len(responseBody)))
+			w.Write(responseBody)
+		}), tt.opts)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		h.ServeHTTP(w, r)
+		if enc := w.Header().Get("Content-Encoding"); enc != tt.want {
+			t.Errorf("%s: wrong content encoding, got %q want %q", tt.contentType, enc, tt.want)
+		}
+		if tt.want == "" {
+			if l := w.Header().Get("Content-Length"); l != strconv.Itoa(len(responseBody)) {
+				t.Errorf("%s: wrong content-length, got %q", tt.contentType, l)
+			}
+			if !bytes.Equal(w.Body.Bytes(), responseBody) {
+				t.Errorf("%s: body was modified", tt.contentType)
+			}
+		}
+	}
+}
+
+func TestPooledWriterReuse(t *testing.T) {
+	t.Parallel()
+	for range 3 {
+		w := httptest.NewRecorder()
+		compressedRequest(w, "gzip")
+		zr, err := gzip.NewReader(bytes.NewReader(w.Body.Bytes()))
+		if err != nil {
+			t.Fatalf("create gzip reader: %v", err)
+		}
+		assertResponseBody(t, zr)
+		zr.Close()
+
+		w = httptest.NewRecorder()
+		compressedRequest(w, "deflate")
+		assertResponseBody(t, flate.NewReader(bytes.NewReader(w.Body.Bytes())))
+	}
+}
+
+func benchmarkCompress(b *testing.B, h http.Handler, encoding string) {
+	b.Helper()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", encoding)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(responseBody)))
+	b.ResetTimer()
+	for range b.N {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+	}
+}
+
+var benchmarkHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	w.Write(responseBody)
+})
+
+func BenchmarkCompressGzip(b *testing.B) {
+	benchmarkCompress(b, GZip(benchmarkHandler), "gzip")
+}
+
+func BenchmarkCompressDeflate(b *testing.B) {
+	benchmarkCompress(b, GZip(benchmarkHandler), "deflate")
+}
+
+// The Unpooled benchmarks allocate a new writer for every response, for
+// comparison with the pooled writers used by GzipEncoding and
+// DeflateEncoding.
+
+func BenchmarkCompressGzipUnpooled(b *testing.B) {
+	h := Compress(benchmarkHandler, &CompressOptions{Encodings: []Encoding{{
+		Name: "gzip",
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, level)
+		},
+	}}})
+	benchmarkCompress(b, h, "gzip")
+}
+
+func BenchmarkCompressDeflateUnpooled(b *testing.B) {
+	h := Compress(benchmarkHandler, &CompressOptions{Encodings: []Encoding{{
+		Name: "deflate",
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return flate.NewWriter(w, level)
+		},
+	}}})
+	benchmarkCompress(b, h, "deflate")
+}
+
+func TestCompressBodylessResponses(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		method string
+		status int
+	}{
+		{"HEAD", http.StatusOK},
+		{"GET", http.StatusNoContent},
+		{"GET", http.StatusNotModified},
+	}
+	for _, tt := range tests {
+		h := GZip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("Content-Length", strconv.Itoa(len(responseBody)))
+			w.WriteHeader(tt.status)
+		}))
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(tt.method, "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		h.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s %d: wrong status code, got %d", tt.method, tt.status, w.Code)
+		}
+		if enc := w.Header().Get("Content-Encoding"); enc != "" {
+			t.Errorf("%s %d: wrong content encoding, got %q want %q", tt.method, tt.status, enc, "")
+		}
+		if w.Body.Len() != 0 {
+			t.Errorf("%s %d: expected empty body, got %q", tt.method, tt.status, w.Body.String())
+		}
+		if l := w.Header().Get("Content-Length"); l != strconv.Itoa(len(responseBody)) {
+			t.Errorf("%s %d: wrong content-length, got %q", tt.method, tt.status, l)
+		}
+	}
+}
+
+func TestCompressAlreadyEncoded(t *testing.T) {
+	t.Parallel()
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	zw.Write(responseBody)
+	zw.Close()
+	h := GZip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(gzipped.Len()))
+		w.Write(gzipped.Bytes())
+	}))
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	h.ServeHTTP(w, r)
+	if enc := w.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Errorf("wrong content encoding, got %q want %q", enc, "gzip")
+	}
+	if !bytes.Equal(w.Body.Bytes(), gzipped.Bytes()) {
+		t.Fatalf("body was double encoded")
+	}
+	if l := w.Header().Get("Content-Length"); l != strconv.Itoa(gzipped.Len()) {
+		t.Errorf("wrong content-length, got %q want %d", l, gzipped.Len())
+	}
+}
@@ -0,0 +1,395 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// htpasswdCheckInterval is how often an HtpasswdFile checks whether the file
+// on disk has changed.
+const htpasswdCheckInterval = time.Second
+
+// defaultDummyHash is checked for unknown users if the file has no entries.
+const defaultDummyHash = "$2a$10$RMbrCyOBVxhq4eizFXSWrO61FlhtIdyRYpy3zvZRCRwOd5g7Ru/uC"
+
+// checkPassword is checkPasswordHash; tests replace it to see which hashes
+// are checked.
+var checkPassword = checkPasswordHash
+
+// An HtpasswdFile is an Authenticator backed by an Apache style htpasswd file,
+// with one "user:hash" entry per line. Blank lines and lines starting with "#"
+// are ignored. The supported hash formats are:
+//
+//   - bcrypt ("$2y$", "$2a$" or "$2b$"), as written by "htpasswd -B"
+//   - SHA-256 crypt ("$5$"), as written by "htpasswd -2"
+//   - Argon2 ("$argon2id$" or "$argon2i$"), in the PHC string format
+//     written by the argon2 command line tool
+//
+// The file is reloaded when it changes on disk, at most once a second. If the
+// new contents can't be loaded, the error is logged and the previous entries
+// remain in use.
+//
+// Passwords for unknown users are checked against a dummy hash with the same
+// format and cost as an entry in the file, so that unknown users take as long
+// to reject as wrong passwords.
+type HtpasswdFile struct {
+	path string
+
+	mu      sync.RWMutex
+	users   map[string]string
+	dummy   string
+	modTime time.Time
+	size    int64
+	checked time.Time
+}
+
+// NewHtpasswdFile loads the htpasswd file at path. It returns an error if the
+// file can't be read, or contains a line that isn't a "user:hash" pair with
+// a supported hash.
+func NewHtpasswdFile(path string) (*HtpasswdFile, error) {
+	f := &HtpasswdFile{path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads the file from disk again. If the file can't be loaded, the
+// previous entries remain in use.
+func (f *HtpasswdFile) Reload() error {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	users, err := parseHtpasswd(data)
+	if err != nil {
+		return fmt.Errorf("handlers: could not load %s: %w", f.path, err)
+	}
+	dummy := defaultDummyHash
+	first := ""
+	for user, hash := range users {
+		if first == "" || user < first {
+			first, dummy = user, dummyHash(hash)
+		}
+	}
+	f.mu.Lock()
+	f.users = users
+	f.dummy = dummy
+	f.modTime = fi.ModTime()
+	f.size = fi.Size()
+	f.checked = time.Now()
+	f.mu.Unlock()
+	return nil
+}
+
+// maybeReload reloads the file if it has changed since it was last loaded.
+func (f *HtpasswdFile) maybeReload() {
+	f.mu.Lock()
+	if time.Since(f.checked) < htpasswdCheckInterval {
+		f.mu.Unlock()
+		return
+	}
+	f.checked = time.Now()
+	modTime, size := f.modTime, f.size
+	f.mu.Unlock()
+
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		Logger.Error("could not stat htpasswd file", "path", f.path, "err", err)
+		return
+	}
+	if fi.ModTime().Equal(modTime) && fi.Size() == size {
+		return
+	}
+	if err := f.Reload(); err != nil {
+		Logger.Error("could not reload htpasswd file", "path", f.path, "err", err)
+	}
+}
+
+// Authenticate checks password against the hash stored for user.
+func (f *HtpasswdFile) Authenticate(user, password string) error {
+	f.maybeReload()
+	f.mu.RLock()
+	hash, ok := f.users[user]
+	if !ok {
+		hash = f.dummy
+	}
+	f.mu.RUnlock()
+	match, err := checkPassword(hash, password)
+	if !ok {
+		return ErrUnknownUser
+	}
+	if err != nil {
+		return err
+	}
+	if !match {
+		return ErrIncorrectPassword
+	}
+	return nil
+}
+
+func parseHtpasswd(data []byte) (map[string]string, error) {
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d: expected user:hash", lineno)
+		}
+		if !supportedHash(hash) {
+			return nil, fmt.Errorf("line %d: unsupported hash format for user %q", lineno, user)
+		}
+		if strings.HasPrefix(hash, "$argon2") {
+			if _, err := parseArgon2(hash); err != nil {
+				return nil, fmt.Errorf("line %d: bad hash for user %q: %w", lineno, user, err)
+			}
+		}
+		users[user] = hash
+	}
+	return users, scanner.Err()
+}
+
+func supportedHash(hash string) bool {
+	for _, prefix := range []string{"$2y$", "$2a$", "$2b$", "$5$", "$argon2id$", "$argon2i$"} {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// dummyHash returns hash with its digest replaced, so that checking
+// a password against it costs the same as checking against hash, but no user
+// has it.
+func dummyHash(hash string) string {
+	filler := "."
+	if strings.HasPrefix(hash, "$argon2") {
+		filler = "A"
+	}
+	n := len(hash) - strings.LastIndexByte(hash, '$') - 1
+	if strings.HasPrefix(hash, "$2") {
+		// The bcrypt salt and digest aren't separated; the digest is the
+		// last 31 characters.
+		n = 31
+	}
+	if n > len(hash) {
+		return defaultDummyHash
+	}
+	return hash[:len(hash)-n] + strings.Repeat(filler, n)
+}
+
+// checkPasswordHash reports whether password matches hash. It returns an
+// error if hash is malformed.
+func checkPasswordHash(hash, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(hash, "$5$"):
+		want, err := sha256Crypt(password, hash)
+		if err != nil {
+			return false, err
+		}
+		return subtle.ConstantTimeCompare([]byte(want), []byte(hash)) == 1, nil
+	case strings.HasPrefix(hash, "$argon2"):
+		return checkArgon2(hash, password)
+	}
+	return false, errors.New("handlers: unsupported password hash format")
+}
+
+// checkArgon2 checks password against a PHC formatted Argon2 hash, like
+// "$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>".
+func checkArgon2(hash, password string) (bool, error) {
+	p, err := parseArgon2(hash)
+	if err != nil {
+		return false, fmt.Errorf("handlers: %w", err)
+	}
+	var got []byte
+	if p.id {
+		got = argon2.IDKey([]byte(password), p.salt, p.iterations, p.memory, p.threads, uint32(len(p.key)))
+	} else {
+		got = argon2.Key([]byte(password), p.salt, p.iterations, p.memory, p.threads, uint32(len(p.key)))
+	}
+	return subtle.ConstantTimeCompare(got, p.key) == 1, nil
+}
+
+// maxArgon2Memory is the most memory, in KiB, that an Argon2 hash may use.
+const maxArgon2Memory = 1 << 20
+
+// argon2Params are the parts of a PHC formatted Argon2 hash.
+type argon2Params struct {
+	id         bool // argon2id, rather than argon2i
+	memory     uint32
+	iterations uint32
+	threads    uint8
+	salt       []byte
+	key        []byte
+}
+
+// parseArgon2 parses a PHC formatted Argon2 hash, and checks that its
+// parameters are in range.
+func parseArgon2(hash string) (*argon2Params, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" && parts[1] != "argon2i" {
+		return nil, errors.New("malformed argon2 hash")
+	}
+	p := &argon2Params{id: parts[1] == "argon2id"}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.iterations, &p.threads); err != nil {
+		return nil, fmt.Errorf("malformed argon2 parameters %q", parts[3])
+	}
+	if p.iterations < 1 || p.threads < 1 || p.memory < 8*uint32(p.threads) || p.memory > maxArgon2Memory {
+		return nil, fmt.Errorf("argon2 parameters out of range %q", parts[3])
+	}
+	var err error
+	if p.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil || len(p.salt) < 8 {
+		return nil, fmt.Errorf("malformed argon2 salt %q", parts[4])
+	}
+	if p.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(p.key) < 4 {
+		return nil, errors.New("malformed argon2 hash")
+	}
+	return p, nil
+}
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// sha256Crypt hashes password with the salt and rounds from setting, using the
+// SHA-256 crypt algorithm (https://www.akkadia.org/drepper/SHA-crypt.txt), and
+// returns the full "$5$..." string.
+func sha256Crypt(password, setting string) (string, error) {
+	const defaultRounds, minRounds, maxRounds = 5000, 1000, 999999999
+	spec := strings.TrimPrefix(setting, "$5$")
+	rounds, explicitRounds := defaultRounds, false
+	if r, ok := strings.CutPrefix(spec, "rounds="); ok {
+		n, after, ok := strings.Cut(r, "$")
+		if !ok {
+			return "", errors.New("handlers: malformed SHA-256 crypt hash")
+		}
+		parsed, err := strconv.Atoi(n)
+		if err != nil {
+			return "", fmt.Errorf("handlers: malformed SHA-256 crypt rounds %q", n)
+		}
+		rounds = min(max(parsed, minRounds), maxRounds)
+		explicitRounds = true
+		spec = after
+	}
+	salt, _, _ := strings.Cut(spec, "$")
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+	pw, s := []byte(password), []byte(salt)
+
+	alt := sha256.New()
+	alt.Write(pw)
+	alt.Write(s)
+	alt.Write(pw)
+	b := alt.Sum(nil)
+
+	a := sha256.New()
+	a.Write(pw)
+	a.Write(s)
+	for n := len(pw); n > 0; n -= sha256.Size {
+		a.Write(b[:min(n, sha256.Size)])
+	}
+	for n := len(pw); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			a.Write(b)
+		} else {
+			a.Write(pw)
+		}
+	}
+	digest := a.Sum(nil)
+
+	dp := sha256.New()
+	for range len(pw) {
+		dp.Write(pw)
+	}
+	p := repeatBytes(dp.Sum(nil), len(pw))
+
+	ds := sha256.New()
+	for range 16 + int(digest[0]) {
+		ds.Write(s)
+	}
+	sBytes := repeatBytes(ds.Sum(nil), len(s))
+
+	for i := range rounds {
+		c := sha256.New()
+		if i%2 != 0 {
+			c.Write(p)
+		} else {
+			c.Write(digest)
+		}
+		if i%3 != 0 {
+			c.Write(sBytes)
+		}
+		if i%7 != 0 {
+			c.Write(p)
+		}
+		if i%2 != 0 {
+			c.Write(digest)
+		} else {
+			c.Write(p)
+		}
+		digest = c.Sum(digest[:0])
+	}
+
+	var out strings.Builder
+	out.WriteString("$5$")
+	if explicitRounds {
+		fmt.Fprintf(&out, "rounds=%d$", rounds)
+	}
+	out.WriteString(salt)
+	out.WriteByte('$')
+	encode := func(b2, b1, b0 byte, n int) {
+		w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+		for range n {
+			out.WriteByte(cryptAlphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+	for i := range 10 {
+		// The bytes are permuted in groups of three: (0, 10, 20),
+		// (21, 1, 11), (12, 22, 2), and so on.
+		idx := [3]int{i, i + 10, i + 20}
+		rot := i % 3
+		encode(digest[idx[(3-rot)%3]], digest[idx[(4-rot)%3]], digest[idx[(5-rot)%3]], 4)
+	}
+	encode(0, digest[31], digest[30], 3)
+	return out.String(), nil
+}
+
+// repeatBytes returns the first n bytes of b repeated.
+func repeatBytes(b []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, b[:min(len(b), n-len(out))]...)
+	}
+	return out
+}
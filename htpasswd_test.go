@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSHA256Crypt(t *testing.T) {
+	t.Parallel()
+	// Test vectors from https://www.akkadia.org/drepper/SHA-crypt.txt
+	tests := []struct {
+		setting, password, want string
+	}{
+		{"$5$saltstring", "Hello world!", "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"},
+		{"$5$rounds=10000$saltstringsaltstring", "Hello world!", "$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA"},
+		{"$5$rounds=5000$toolongsaltstring", "This is just a test", "$5$rounds=5000$toolongsaltstrin$Un/5jzAHMgOGZ5.mWJpuVolil07guHPvOW8mGRcvxa5"},
+		{"$5$rounds=10$roundstoolow", "the minimum number is still observed", "$5$rounds=1000$roundstoolow$yfvwcWrQ8l/K0DAWyuPMDNHpIVlTQebY9l/gL972bIC"},
+	}
+	for _, tt := range tests {
+		got, err := sha256Crypt(tt.password, tt.setting)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.setting, got, tt.want)
+		}
+	}
+}
+
+func argon2Hash(password string) string {
+	salt := []byte("somesaltsomesalt")
+	key := argon2.IDKey([]byte(password), salt, 1, 64, 1, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=64,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func TestHtpasswdFile(t *testing.T) {
+	t.Parallel()
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("bcryptpass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	contents := fmt.Sprintf("# comment\n\nbob:%s\nsam:$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5\nana:%s\n",
+		bcryptHash, argon2Hash("argonpass"))
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewHtpasswdFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		user, password string
+		want           error
+	}{
+		{"bob", "bcryptpass", nil},
+		{"bob", "wrong", ErrIncorrectPassword},
+		{"sam", "Hello world!", nil},
+		{"sam", "Hello world", ErrIncorrectPassword},
+		{"ana", "argonpass", nil},
+		{"ana", "argonpas", ErrIncorrectPassword},
+		{"eve", "bcryptpass", ErrUnknownUser},
+	}
+	for _, tt := range tests {
+		if err := f.Authenticate(tt.user, tt.password); !errors.Is(err, tt.want) {
+			t.Errorf("%s/%s: got %v, want %v", tt.user, tt.password, err, tt.want)
+		}
+	}
+}
+
+func TestDummyHash(t *testing.T) {
+	t.Parallel()
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range []string{
+		string(bcryptHash),
+		"$5$rounds=1000$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5",
+		argon2Hash("pass"),
+	} {
+		dummy := dummyHash(hash)
+		if dummy == hash || len(dummy) != len(hash) {
+			t.Errorf("dummyHash(%q) = %q, want a different hash of the same length", hash, dummy)
+		}
+		if match, err := checkPasswordHash(dummy, "pass"); match || err != nil {
+			t.Errorf("checking %q: got %t, %v, want false, nil", dummy, match, err)
+		}
+	}
+}
+
+// Not parallel, since it replaces checkPassword and comparePasswords.
+func TestUnknownUserChecksPassword(t *testing.T) {
+	defer func(f func(string, string) (bool, error)) { checkPassword = f }(checkPassword)
+	defer func(f func(string, string) bool) { comparePasswords = f }(comparePasswords)
+	var checked []string
+	checkPassword = func(hash, password string) (bool, error) {
+		checked = append(checked, hash)
+		return checkPasswordHash(hash, password)
+	}
+	compared := 0
+	comparePasswords = func(a, b string) bool {
+		compared++
+		return a == b
+	}
+
+	if err := StaticUsers(map[string]string{"bob": "secret"}).Authenticate("eve", "secret"); !errors.Is(err, ErrUnknownUser) {
+		t.Errorf("got %v, want ErrUnknownUser", err)
+	}
+	if compared != 1 {
+		t.Errorf("expected StaticUsers to compare the password for an unknown user, got %d comparisons", compared)
+	}
+
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(path, []byte("ana:"+argon2Hash("pass")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewHtpasswdFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Authenticate("eve", "pass"); !errors.Is(err, ErrUnknownUser) {
+		t.Errorf("got %v, want ErrUnknownUser", err)
+	}
+	if len(checked) != 1 || !strings.HasPrefix(checked[0], "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("expected one check against an argon2 hash with the file's cost, got %q", checked)
+	}
+
+	// An empty file falls back to a bcrypt hash.
+	checked = nil
+	empty := filepath.Join(t.TempDir(), "empty")
+	if err := os.WriteFile(empty, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if f, err = NewHtpasswdFile(empty); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Authenticate("eve", "pass"); !errors.Is(err, ErrUnknownUser) {
+		t.Errorf("got %v, want ErrUnknownUser", err)
+	}
+	if len(checked) != 1 || checked[0] != defaultDummyHash {
+		t.Errorf("expected one check against the default dummy hash, got %q", checked)
+	}
+}
+
+func TestHtpasswdFileReload(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(path, []byte("ana:"+argon2Hash("first")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewHtpasswdFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Authenticate("ana", "first"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, []byte("ana:"+argon2Hash("second")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Don't wait for the check interval to pass, or depend on the
+	// filesystem's timestamp granularity.
+	f.mu.Lock()
+	f.checked = time.Time{}
+	f.modTime = time.Time{}
+	f.mu.Unlock()
+	if err := f.Authenticate("ana", "second"); err != nil {
+		t.Errorf("expected new password to work after reload, got %v", err)
+	}
+
+	// A broken file keeps the old entries.
+	if err := os.WriteFile(path, []byte("ana:plaintext\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	f.checked = time.Time{}
+	f.mu.Unlock()
+	if err := f.Authenticate("ana", "second"); err != nil {
+		t.Errorf("expected old entries to remain after a failed reload, got %v", err)
+	}
+}
+
+func TestNewHtpasswdFileInvalid(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(path, []byte("bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewHtpasswdFile(path); err == nil {
+		t.Error("expected an error for an unsupported hash")
+	}
+	if _, err := NewHtpasswdFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+
+	valid := argon2Hash("pass")
+	for _, hash := range []string{
+		strings.Replace(valid, "t=1", "t=0", 1),
+		strings.Replace(valid, "p=1", "p=0", 1),
+		strings.Replace(valid, "m=64", "m=4", 1),
+		strings.Replace(valid, "m=64", "m=99999999", 1),
+		strings.Replace(valid, "p=1", "p=300", 1),
+		strings.Replace(valid, "m=64,t=1,p=1", "m=64", 1),
+		strings.Replace(valid, "$argon2id$", "$argon2d$", 1),
+		strings.Replace(valid, "c29tZXNhbHRzb21lc2FsdA", "c29tZX!h", 1),
+		valid[:strings.LastIndexByte(valid, '$')+1],
+		valid + "$extra",
+	} {
+		if err := os.WriteFile(path, []byte("ana:"+hash+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewHtpasswdFile(path); err == nil {
+			t.Errorf("expected an error for argon2 hash %q", hash)
+		}
+		// Checking a password against a bad hash is an error, not a panic.
+		if _, err := checkPasswordHash(hash, "pass"); err == nil {
+			t.Errorf("expected an error checking against %q", hash)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package handlers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultJWKSRefreshInterval is how long a JWKS caches keys if no
+// RefreshInterval is set.
+const DefaultJWKSRefreshInterval = time.Hour
+
+// DefaultJWKSMinRefreshInterval is how often a JWKS may reload its keys when
+// it sees an unknown key ID, if no MinRefreshInterval is set.
+const DefaultJWKSMinRefreshInterval = 30 * time.Second
+
+// maxJWKSSize is the largest JWKS document we'll load.
+const maxJWKSSize = 1 << 20
+
+// jwksFetchTimeout bounds a single load of a JWKS. Loads don't use the
+// context of the request that triggered them, so they aren't canceled
+// when that request is.
+const jwksFetchTimeout = 10 * time.Second
+
+// A JWKS is a JWTKeySource that loads keys from a JSON Web Key Set (RFC 7517)
+// in a local file or at a URL. Keys are loaded on first use and cached for
+// RefreshInterval. A token signed with an unknown key ID causes the keys to
+// be reloaded, at most once every MinRefreshInterval, so that keys can be
+// rotated without a restart. Reloads run in the background while the
+// previous keys keep being served, and concurrent requests share a single
+// reload. If a reload fails, the error is logged and the previous keys remain
+// in use.
+//
+// RSA keys are used for RS256, P-256 EC keys for ES256, and symmetric ("oct")
+// keys for HS256. Set any options before the first call to JWTKey.
+type JWKS struct {
+	// RefreshInterval is how long keys are cached. If zero,
+	// DefaultJWKSRefreshInterval is used.
+	RefreshInterval time.Duration
+
+	// MinRefreshInterval limits how often an unknown key ID causes the keys
+	// to be reloaded. If zero, DefaultJWKSMinRefreshInterval is used.
+	MinRefreshInterval time.Duration
+
+	// Client is used to fetch keys from a URL. If nil, a client with a ten
+	// second timeout is used.
+	Client *http.Client
+
+	load func(ctx context.Context, j *JWKS) ([]byte, error)
+
+	mu       sync.Mutex
+	keys     []jwk
+	loaded   time.Time
+	checked  time.Time
+	inflight *jwksFetch // the reload in progress, if any
+}
+
+// jwksFetch is a reload of a JWKS. err is set before done is closed.
+type jwksFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// NewJWKSFile returns a JWKS that loads keys from the file at path.
+func NewJWKSFile(path string) *JWKS {
+	return &JWKS{load: func(ctx context.Context, j *JWKS) ([]byte, error) {
+		return os.ReadFile(path)
+	}}
+}
+
+// NewJWKSURL returns a JWKS that loads keys from url, usually the jwks_uri of
+// an OpenID Connect provider.
+func NewJWKSURL(url string) *JWKS {
+	return &JWKS{load: func(ctx context.Context, j *JWKS) ([]byte, error) {
+		client := j.Client
+		if client == nil {
+			client = &http.Client{Timeout: 10 * time.Second}
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("handlers: could not fetch JWKS from %s: status %d", url, resp.StatusCode)
+		}
+		return io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize))
+	}}
+}
+
+// jwk is a parsed JSON Web Key.
+type jwk struct {
+	kid string
+	alg string
+	key any
+}
+
+// Refresh loads the keys now. Call it at startup to check that the key set
+// is reachable and valid. If ctx is canceled, Refresh returns early, but the
+// load carries on in the background.
+func (j *JWKS) Refresh(ctx context.Context) error {
+	j.mu.Lock()
+	f := j.startFetchLocked()
+	j.mu.Unlock()
+	return f.wait(ctx)
+}
+
+// startFetchLocked starts loading the keys in the background, or returns the
+// load that's already running. j.mu must be held.
+func (j *JWKS) startFetchLocked() *jwksFetch {
+	if j.inflight != nil {
+		return j.inflight
+	}
+	f := &jwksFetch{done: make(chan struct{})}
+	j.inflight = f
+	j.checked = time.Now()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), jwksFetchTimeout)
+		defer cancel()
+		var keys []jwk
+		data, err := j.load(ctx, j)
+		if err == nil {
+			keys, err = parseJWKS(data)
+		}
+		j.mu.Lock()
+		if err == nil {
+			j.keys = keys
+			j.loaded = time.Now()
+		} else if j.keys != nil {
+			Logger.Error("could not refresh JWKS", "err", err)
+		}
+		j.inflight = nil
+		f.err = err
+		close(f.done)
+		j.mu.Unlock()
+	}()
+	return f
+}
+
+func (f *jwksFetch) wait(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// JWTKey returns the key with the given ID that can verify tokens signed with
+// alg. If kid is empty, the first such key is used.
+//
+// JWTKey only waits for the keys to load if none have been loaded yet, or if
+// kid is unknown.
+func (j *JWKS) JWTKey(ctx context.Context, kid, alg string) (any, error) {
+	refresh := j.RefreshInterval
+	if refresh == 0 {
+		refresh = DefaultJWKSRefreshInterval
+	}
+	minRefresh := j.MinRefreshInterval
+	if minRefresh == 0 {
+		minRefresh = DefaultJWKSMinRefreshInterval
+	}
+	j.mu.Lock()
+	if time.Since(j.loaded) > refresh && time.Since(j.checked) > minRefresh {
+		j.startFetchLocked()
+	}
+	if j.keys == nil {
+		f := j.inflight
+		j.mu.Unlock()
+		if f == nil {
+			return nil, errors.New("handlers: JWKS has not been loaded")
+		}
+		if err := f.wait(ctx); err != nil {
+			return nil, err
+		}
+		j.mu.Lock()
+	}
+	key, ok := j.find(kid, alg)
+	var f *jwksFetch
+	if !ok && (j.inflight != nil || time.Since(j.checked) > minRefresh) {
+		f = j.startFetchLocked()
+	}
+	j.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if f != nil {
+		// A failed reload has already been logged; the token is rejected
+		// below.
+		if err := f.wait(ctx); err == nil {
+			j.mu.Lock()
+			key, ok = j.find(kid, alg)
+			j.mu.Unlock()
+			if ok {
+				return key, nil
+			}
+		} else if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+	return nil, invalidJWT("unknown key ID %q", kid)
+}
+
+func (j *JWKS) find(kid, alg string) (any, bool) {
+	for _, k := range j.keys {
+		if (kid == "" || k.kid == kid) && (k.alg == "" || k.alg == alg) && keyMatchesAlg(k.key, alg) {
+			return k.key, true
+		}
+	}
+	return nil, false
+}
+
+func keyMatchesAlg(key any, alg string) bool {
+	switch key.(type) {
+	case []byte:
+		return alg == JWTAlgHS256
+	case *rsa.PublicKey:
+		return alg == JWTAlgRS256
+	case *ecdsa.PublicKey:
+		return alg == JWTAlgES256
+	}
+	return false
+}
+
+// parseJWKS parses a JSON Web Key Set. Keys with unsupported types or curves,
+// or that aren't for signing, are skipped.
+func parseJWKS(data []byte) ([]jwk, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("handlers: could not parse JWKS: %w", err)
+	}
+	keys := make([]jwk, 0, len(set.Keys))
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key any
+		var err error
+		switch k.Kty {
+		case "RSA":
+			key, err = parseRSAJWK(k.N, k.E)
+		case "EC":
+			if k.Crv != "P-256" {
+				continue
+			}
+			key, err = parseECJWK(k.X, k.Y)
+		case "oct":
+			key, err = base64.RawURLEncoding.DecodeString(k.K)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("handlers: could not parse key %d (%q) in JWKS: %w", i, k.Kid, err)
+		}
+		keys = append(keys, jwk{kid: k.Kid, alg: k.Alg, key: key})
+	}
+	return keys, nil
+}
+
+func parseRSAJWK(n, e string) (*rsa.PublicKey, error) {
+	nb, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, err
+	}
+	eb, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, err
+	}
+	exp := new(big.Int).SetBytes(eb)
+	if len(nb) == 0 || !exp.IsInt64() || exp.Int64() < 3 || exp.Int64() > 1<<31-1 {
+		return nil, errors.New("invalid RSA key")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(nb), E: int(exp.Int64())}, nil
+}
+
+func parseECJWK(x, y string) (*ecdsa.PublicKey, error) {
+	xb, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return nil, err
+	}
+	yb, err := base64.RawURLEncoding.DecodeString(y)
+	if err != nil {
+		return nil, err
+	}
+	if len(xb) != 32 || len(yb) != 32 {
+		return nil, errors.New("invalid P-256 key")
+	}
+	point := append(append([]byte{4}, xb...), yb...)
+	return ecdsa.ParseUncompressedPublicKey(elliptic.P256(), point)
+}
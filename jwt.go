@@ -0,0 +1,318 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/kevinburke/rest/v2"
+	"github.com/kevinburke/rest/v2/resterror"
+)
+
+// AuthMethodJWT is the AuthMethod of a Principal authenticated by the JWT
+// handler.
+const AuthMethodJWT = "jwt"
+
+// The signing algorithms supported by the JWT handler.
+const (
+	JWTAlgHS256 = "HS256"
+	JWTAlgRS256 = "RS256"
+	JWTAlgES256 = "ES256"
+)
+
+// A JWTKeySource returns the key for verifying a token signed with alg, and
+// with the given key ID (which may be empty). The key must be a []byte for
+// HS256, an *rsa.PublicKey for RS256, or an *ecdsa.PublicKey for ES256.
+// JWTKey should return an error wrapping ErrInvalidToken if there is no
+// such key. Any other error is treated as a server error.
+type JWTKeySource interface {
+	JWTKey(ctx context.Context, kid, alg string) (any, error)
+}
+
+// The JWTKeyFunc type is an adapter to allow the use of ordinary functions as
+// JWTKeySources.
+type JWTKeyFunc func(ctx context.Context, kid, alg string) (any, error)
+
+// JWTKey calls f(ctx, kid, alg).
+func (f JWTKeyFunc) JWTKey(ctx context.Context, kid, alg string) (any, error) {
+	return f(ctx, kid, alg)
+}
+
+// StaticJWTKey returns a JWTKeySource that verifies every token with key: an
+// HMAC secret ([]byte), an *rsa.PublicKey, or an *ecdsa.PublicKey.
+func StaticJWTKey(key any) JWTKeySource {
+	return JWTKeyFunc(func(ctx context.Context, kid, alg string) (any, error) {
+		return key, nil
+	})
+}
+
+// JWTOptions configures the JWT handler.
+type JWTOptions struct {
+	// Keys looks up the keys used to verify tokens, for example a JWKS.
+	Keys JWTKeySource
+
+	// Algorithms lists the accepted signing algorithms. If Algorithms is
+	// empty, HS256, RS256 and ES256 are accepted. A token is only accepted
+	// if the key returned for it matches its algorithm, so a public RSA key
+	// can never be used as an HMAC secret.
+	Algorithms []string
+
+	// Issuer, if set, must match the token's "iss" claim.
+	Issuer string
+
+	// Audience, if set, must be one of the values in the token's "aud"
+	// claim.
+	Audience string
+
+	// ClockSkew is the leeway allowed when checking the "exp" and "nbf"
+	// claims, to account for clock differences between servers.
+	ClockSkew time.Duration
+
+	// RequireExpiry rejects tokens without an "exp" claim. Otherwise such
+	// tokens never expire.
+	RequireExpiry bool
+
+	// Realm is sent in the WWW-Authenticate header of 401 responses.
+	Realm string
+}
+
+// JWTClaims are the claims of a verified JSON Web Token.
+type JWTClaims struct {
+	Issuer    string
+	Subject   string
+	Audience  []string
+	ExpiresAt time.Time
+	NotBefore time.Time
+	IssuedAt  time.Time
+	ID        string
+
+	// Raw holds every claim in the token, decoded with numbers as
+	// json.Number values.
+	Raw map[string]any
+}
+
+// JWT protects all requests to the given handler, unless the request has an
+// "Authorization: Bearer <token>" header with a JSON Web Token signed by one
+// of the keys in opts.Keys, whose exp, nbf, iss and aud claims are valid.
+// Requests without a token get a 401 response, and requests with an invalid
+// token get a 403 response.
+//
+// The token's claims are available to h via GetJWTClaims. The token's subject
+// is available as a Principal via GetUser, with roles from the "roles" claim,
+// if it is a list of strings.
+func JWT(h http.Handler, opts JWTOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, method, ok := tokenFromRequest(r)
+		if !ok || method == AuthMethodAPIKey {
+			bearerError(w, r, opts.Realm, "invalid_request", "Provide a single bearer token")
+			return
+		}
+		if token == "" {
+			bearerError(w, r, opts.Realm, "", "")
+			return
+		}
+		claims, err := opts.verify(r.Context(), token, time.Now())
+		if err != nil {
+			if jerr := new(jwtError); errors.As(err, &jerr) {
+				rest.Forbidden(w, r, &resterror.Error{
+					Title:    "Invalid token: " + jerr.msg,
+					ID:       "invalid_token",
+					Instance: r.URL.Path,
+				})
+				return
+			}
+			if errors.Is(err, ErrInvalidToken) {
+				rest.Forbidden(w, r, &resterror.Error{
+					Title:    "Invalid token",
+					ID:       "invalid_token",
+					Instance: r.URL.Path,
+				})
+				return
+			}
+			rest.ServerError(w, r, err)
+			return
+		}
+		p := &Principal{Username: claims.Subject, AuthMethod: AuthMethodJWT}
+		if roles, ok := claims.Raw["roles"].([]any); ok {
+			for _, role := range roles {
+				if s, ok := role.(string); ok {
+					p.Roles = append(p.Roles, s)
+				}
+			}
+		}
+		r = SetUser(r, p)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), jwtClaims, claims)))
+	})
+}
+
+// GetJWTClaims returns the claims of the token verified by the JWT handler,
+// or false if the JWT handler did not run.
+func GetJWTClaims(ctx context.Context) (*JWTClaims, bool) {
+	claims, ok := ctx.Value(jwtClaims).(*JWTClaims)
+	return claims, ok
+}
+
+// jwtError is a reason for rejecting a token. It wraps ErrInvalidToken.
+type jwtError struct {
+	msg string
+}
+
+func (e *jwtError) Error() string { return "handlers: invalid JWT: " + e.msg }
+func (e *jwtError) Unwrap() error { return ErrInvalidToken }
+
+func invalidJWT(format string, args ...any) error {
+	return &jwtError{msg: fmt.Sprintf(format, args...)}
+}
+
+// verify checks the signature and claims of token at time now.
+func (o *JWTOptions) verify(ctx context.Context, token string, now time.Time) (*JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, invalidJWT("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, invalidJWT("malformed header")
+	}
+	algs := o.Algorithms
+	if len(algs) == 0 {
+		algs = []string{JWTAlgHS256, JWTAlgRS256, JWTAlgES256}
+	}
+	if !slices.Contains(algs, header.Alg) {
+		return nil, invalidJWT("unsupported algorithm %q", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, invalidJWT("malformed signature")
+	}
+	key, err := o.Keys.JWTKey(ctx, header.Kid, header.Alg)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var payload struct {
+		Iss string          `json:"iss"`
+		Sub string          `json:"sub"`
+		Aud json.RawMessage `json:"aud"`
+		Exp *json.Number    `json:"exp"`
+		Nbf *json.Number    `json:"nbf"`
+		Iat *json.Number    `json:"iat"`
+		Jti string          `json:"jti"`
+	}
+	claims := &JWTClaims{}
+	if decodeJWTSegment(parts[1], &payload) != nil || decodeJWTSegment(parts[1], &claims.Raw) != nil {
+		return nil, invalidJWT("malformed claims")
+	}
+	claims.Issuer, claims.Subject, claims.ID = payload.Iss, payload.Sub, payload.Jti
+	if len(payload.Aud) > 0 {
+		var aud string
+		if json.Unmarshal(payload.Aud, &aud) == nil {
+			claims.Audience = []string{aud}
+		} else if json.Unmarshal(payload.Aud, &claims.Audience) != nil {
+			return nil, invalidJWT("malformed aud claim")
+		}
+	}
+	for _, c := range []struct {
+		name string
+		n    *json.Number
+		t    *time.Time
+	}{{"exp", payload.Exp, &claims.ExpiresAt}, {"nbf", payload.Nbf, &claims.NotBefore}, {"iat", payload.Iat, &claims.IssuedAt}} {
+		if c.n == nil {
+			continue
+		}
+		f, err := c.n.Float64()
+		if err != nil {
+			return nil, invalidJWT("malformed %s claim", c.name)
+		}
+		sec, frac := math.Modf(f)
+		*c.t = time.Unix(int64(sec), int64(frac*float64(time.Second)))
+	}
+
+	if claims.ExpiresAt.IsZero() && o.RequireExpiry {
+		return nil, invalidJWT("token has no expiry")
+	}
+	if !claims.ExpiresAt.IsZero() && now.After(claims.ExpiresAt.Add(o.ClockSkew)) {
+		return nil, invalidJWT("token has expired")
+	}
+	if !claims.NotBefore.IsZero() && now.Add(o.ClockSkew).Before(claims.NotBefore) {
+		return nil, invalidJWT("token is not valid yet")
+	}
+	if o.Issuer != "" && claims.Issuer != o.Issuer {
+		return nil, invalidJWT("unexpected issuer %q", claims.Issuer)
+	}
+	if o.Audience != "" && !slices.Contains(claims.Audience, o.Audience) {
+		return nil, invalidJWT("token is not intended for this audience")
+	}
+	return claims, nil
+}
+
+// decodeJWTSegment decodes a base64url encoded JSON object into v.
+func decodeJWTSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+func verifyJWTSignature(alg string, key any, signed string, sig []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch alg {
+	case JWTAlgHS256:
+		secret, ok := key.([]byte)
+		if !ok {
+			return invalidJWT("key does not match algorithm %s", alg)
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return invalidJWT("bad signature")
+		}
+	case JWTAlgRS256:
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return invalidJWT("key does not match algorithm %s", alg)
+		}
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) != nil {
+			return invalidJWT("bad signature")
+		}
+	case JWTAlgES256:
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve != elliptic.P256() {
+			return invalidJWT("key does not match algorithm %s", alg)
+		}
+		if len(sig) != 64 {
+			return invalidJWT("bad signature")
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return invalidJWT("bad signature")
+		}
+	default:
+		return invalidJWT("unsupported algorithm %q", alg)
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+package handlers
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func signJWT(t testing.TB, alg, kid string, key any, claims map[string]any) string {
+	t.Helper()
+	header := map[string]any{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+var (
+	testRSAKeyOnce sync.Once
+	testRSAKey     *rsa.PrivateKey
+)
+
+func rsaTestKey(t testing.TB) *rsa.PrivateKey {
+	testRSAKeyOnce.Do(func() {
+		var err error
+		testRSAKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	return testRSAKey
+}
+
+// unsigned strips the signature from token.
+func unsigned(token string) string {
+	return token[:strings.LastIndexByte(token, '.')+1]
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func rsaJWK(kid string, pub *rsa.PublicKey) map[string]any {
+	return map[string]any{"kty": "RSA", "kid": kid, "alg": "RS256", "use": "sig",
+		"n": b64(pub.N.Bytes()), "e": b64(big.NewInt(int64(pub.E)).Bytes())}
+}
+
+func ecJWK(kid string, pub *ecdsa.PublicKey) map[string]any {
+	point, _ := pub.Bytes()
+	return map[string]any{"kty": "EC", "kid": kid, "crv": "P-256",
+		"x": b64(point[1:33]), "y": b64(point[33:])}
+}
+
+func TestJWTClaims(t *testing.T) {
+	t.Parallel()
+	secret := []byte("hmac-secret")
+	opts := JWTOptions{
+		Keys:      StaticJWTKey(secret),
+		Issuer:    "https://issuer.example",
+		Audience:  "api",
+		ClockSkew: time.Minute,
+	}
+	var got *JWTClaims
+	var user *Principal
+	h := JWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = GetJWTClaims(r.Context())
+		user, _ = GetUser(r.Context())
+	}), opts)
+	now := time.Now().Unix()
+	valid := map[string]any{"iss": "https://issuer.example", "aud": []string{"other", "api"}, "sub": "user-1", "exp": now + 60, "nbf": now - 60, "roles": []string{"admin"}, "org": "acme"}
+	with := func(k string, v any) map[string]any {
+		c := make(map[string]any)
+		for key, val := range valid {
+			c[key] = val
+		}
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+		return c
+	}
+	tests := []struct {
+		name  string
+		token string
+		code  int
+		title string
+	}{
+		{"valid", signJWT(t, "HS256", "", secret, valid), 200, ""},
+		{"string aud", signJWT(t, "HS256", "", secret, with("aud", "api")), 200, ""},
+		{"no expiry", signJWT(t, "HS256", "", secret, with("exp", nil)), 200, ""},
+		{"expired within skew", signJWT(t, "HS256", "", secret, with("exp", now-30)), 200, ""},
+		{"expired", signJWT(t, "HS256", "", secret, with("exp", now-120)), 403, "Invalid token: token has expired"},
+		{"not yet valid", signJWT(t, "HS256", "", secret, with("nbf", now+120)), 403, "Invalid token: token is not valid yet"},
+		{"wrong issuer", signJWT(t, "HS256", "", secret, with("iss", "https://evil.example")), 403, `Invalid token: unexpected issuer "https://evil.example"`},
+		{"wrong audience", signJWT(t, "HS256", "", secret, with("aud", "other")), 403, "Invalid token: token is not intended for this audience"},
+		{"missing audience", signJWT(t, "HS256", "", secret, with("aud", nil)), 403, "Invalid token: token is not intended for this audience"},
+		{"bad signature", signJWT(t, "HS256", "", []byte("wrong"), valid), 403, "Invalid token: bad signature"},
+		{"alg none", unsigned(signJWT(t, "none", "", secret, valid)), 403, `Invalid token: unsupported algorithm "none"`},
+		{"two segments", "abc.def", 403, "Invalid token: malformed token"},
+		{"alg none with signature", signJWT(t, "none", "", secret, valid), 403, `Invalid token: unsupported algorithm "none"`},
+		{"key type mismatch", signJWT(t, "RS256", "", rsaTestKey(t), valid), 403, "Invalid token: key does not match algorithm RS256"},
+		{"garbage", "not.a.jwt", 403, "Invalid token: malformed header"},
+	}
+	for _, tt := range tests {
+		got, user = nil, nil
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%s: got code %d, want %d: %s", tt.name, w.Code, tt.code, w.Body.String())
+			continue
+		}
+		if tt.code != 200 {
+			var body struct {
+				Title string `json:"title"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &body)
+			if body.Title != tt.title {
+				t.Errorf("%s: got title %q, want %q", tt.name, body.Title, tt.title)
+			}
+			continue
+		}
+		if got == nil || got.Subject != "user-1" || got.Issuer != "https://issuer.example" || got.Raw["org"] != "acme" {
+			t.Errorf("%s: got claims %+v", tt.name, got)
+		}
+		if user == nil || user.Username != "user-1" || user.AuthMethod != AuthMethodJWT || !user.HasRole("admin") {
+			t.Errorf("%s: got principal %+v", tt.name, user)
+		}
+	}
+
+	opts.RequireExpiry = true
+	if _, err := opts.verify(context.Background(), signJWT(t, "HS256", "", secret, with("exp", nil)), time.Now()); !errors.Is(err, ErrInvalidToken) || !strings.Contains(err.Error(), "token has no expiry") {
+		t.Errorf("expected a token without exp to be rejected with RequireExpiry, got %v", err)
+	}
+	if _, err := opts.verify(context.Background(), signJWT(t, "HS256", "", secret, valid), time.Now()); err != nil {
+		t.Errorf("expected a token with exp to be accepted with RequireExpiry, got %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a token, got %d", w.Code)
+	}
+	if hdr := w.Header().Get("WWW-Authenticate"); hdr != `Bearer realm=""` {
+		t.Errorf("got WWW-Authenticate %q", hdr)
+	}
+}
+
+func TestJWKSURL(t *testing.T) {
+	t.Parallel()
+	rsaKey := rsaTestKey(t)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetches atomic.Int32
+	var mu sync.Mutex
+	keys := []map[string]any{rsaJWK("rsa-1", &rsaKey.PublicKey)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		mu.Lock()
+		defer mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	}))
+	defer server.Close()
+
+	jwks := NewJWKSURL(server.URL)
+	jwks.MinRefreshInterval = time.Nanosecond
+	opts := JWTOptions{Keys: jwks}
+	claims := map[string]any{"sub": "user-1", "exp": time.Now().Add(time.Minute).Unix()}
+	ctx := context.Background()
+
+	for range 3 {
+		if _, err := opts.verify(ctx, signJWT(t, "RS256", "rsa-1", rsaKey, claims), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("expected keys to be cached, got %d fetches", n)
+	}
+
+	// Rotate in an EC key; the unknown key ID triggers a refresh.
+	mu.Lock()
+	keys = []map[string]any{ecJWK("ec-2", &ecKey.PublicKey)}
+	mu.Unlock()
+	if _, err := opts.verify(ctx, signJWT(t, "ES256", "ec-2", ecKey, claims), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("expected a refresh for the new key, got %d fetches", n)
+	}
+	_, err = opts.verify(ctx, signJWT(t, "RS256", "rsa-1", rsaKey, claims), time.Now())
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected rotated out key to be rejected, got %v", err)
+	}
+}
+
+func TestJWKSRefreshInBackground(t *testing.T) {
+	t.Parallel()
+	oldKey := rsaTestKey(t)
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetches atomic.Int32
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	jwks := &JWKS{
+		RefreshInterval:    time.Nanosecond,
+		MinRefreshInterval: time.Nanosecond,
+		load: func(ctx context.Context, j *JWKS) ([]byte, error) {
+			keys := []map[string]any{rsaJWK("rsa-1", &oldKey.PublicKey)}
+			if fetches.Add(1) > 1 {
+				select {
+				case started <- struct{}{}:
+				default:
+				}
+				select {
+				case <-release:
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+				keys = append(keys, ecJWK("ec-2", &newKey.PublicKey))
+			}
+			return json.Marshal(map[string]any{"keys": keys})
+		},
+	}
+	if err := jwks.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The keys are stale, so this starts a reload, which blocks. The cached
+	// key is still served, without waiting.
+	for range 3 {
+		if _, err := jwks.JWTKey(context.Background(), "rsa-1", JWTAlgRS256); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An unknown key waits for the reload, until the request is canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := jwks.JWTKey(ctx, "ec-2", JWTAlgES256); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the canceled request to give up, got %v", err)
+	}
+
+	<-started
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("expected concurrent lookups to share one reload, got %d fetches", n)
+	}
+
+	// The reload outlives the canceled request.
+	close(release)
+	if _, err := jwks.JWTKey(context.Background(), "ec-2", JWTAlgES256); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJWKSFile(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	data, _ := json.Marshal(map[string]any{"keys": []map[string]any{
+		{"kty": "oct", "kid": "hmac", "k": b64([]byte("file-secret"))},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": "AA"},
+	}})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	jwks := NewJWKSFile(path)
+	if err := jwks.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	opts := JWTOptions{Keys: jwks}
+	token := signJWT(t, "HS256", "hmac", []byte("file-secret"), map[string]any{"sub": "x"})
+	if _, err := opts.verify(context.Background(), token, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewJWKSFile(filepath.Join(t.TempDir(), "missing")).Refresh(context.Background()); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
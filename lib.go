@@ -11,28 +11,36 @@
 package handlers
 
 import (
-	"bytes"
 	"context"
-	"crypto/subtle"
-	"fmt"
+	"encoding/json"
 	"io"
-	"maps"
+	"net"
 	"net/http"
-	"net/http/httptest"
-	"net/http/httputil"
 	"net/url"
-	"os"
 	"strings"
 	"sync"
 	"time"
 
 	uuid "github.com/gofrs/uuid/v5"
-	"github.com/kevinburke/rest/v2"
 	"github.com/kevinburke/rest/v2/resterror"
 )
 
 const Version = "0.50.0"
 
+// writeError writes err to the client as a JSON problem document with the
+// given status code, in the same format as the errors in the rest package.
+func writeError(w http.ResponseWriter, r *http.Request, status int, err *resterror.Error) {
+	err.Status = status
+	if err.Instance == "" {
+		err.Instance = r.URL.Path
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if encErr := json.NewEncoder(w).Encode(err); encErr != nil {
+		Logger.Info("Couldn't write error", "path", r.URL.Path, "code", status, "err", encErr)
+	}
+}
+
 func push(w http.ResponseWriter, target string, opts *http.PushOptions) error {
 	if pusher, ok := w.(http.Pusher); ok {
 		return pusher.Push(target, opts)
@@ -54,36 +62,33 @@ func JSON(h http.Handler) http.Handler {
 }
 
 type serverWriter struct {
-	w           http.ResponseWriter
+	baseWriter
 	name        string
 	wroteHeader bool
 }
 
-func (s *serverWriter) WriteHeader(code int) {
+func (s *serverWriter) setHeader() {
 	//lint:ignore S1002 prefer it this way
 	if s.wroteHeader == false {
 		s.w.Header().Set("Server", s.name)
 		s.wroteHeader = true
 	}
+}
+
+func (s *serverWriter) WriteHeader(code int) {
+	s.setHeader()
 	s.w.WriteHeader(code)
 }
 
 func (s *serverWriter) Write(b []byte) (int, error) {
-	//lint:ignore S1002 prefer it this way
-	if s.wroteHeader == false {
-		s.w.Header().Set("Server", s.name)
-		s.wroteHeader = true
-	}
+	s.setHeader()
 	return s.w.Write(b)
 }
 
-func (s *serverWriter) Header() http.Header {
-	return s.w.Header()
-}
-
-// Push implements the http.Pusher interface.
-func (s *serverWriter) Push(target string, opts *http.PushOptions) error {
-	return push(s.w, target, opts)
+// ReadFrom implements the io.ReaderFrom interface.
+func (s *serverWriter) ReadFrom(r io.Reader) (int64, error) {
+	s.setHeader()
+	return readFrom(s.w, s.w, r)
 }
 
 // TrailingSlashRedirect redirects any path that ends with a "/" - say,
@@ -102,16 +107,12 @@ func TrailingSlashRedirect(h http.Handler) http.Handler {
 func Server(h http.Handler, serverName string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		sw := &serverWriter{
-			w:           w,
+			baseWriter:  baseWriter{w: w},
 			name:        serverName,
 			wroteHeader: false,
 		}
-		h.ServeHTTP(sw, r)
-		//lint:ignore S1002 prefer it this way
-		if sw.wroteHeader == false {
-			sw.w.Header().Set("Server", sw.name)
-			sw.wroteHeader = true
-		}
+		h.ServeHTTP(wrapWriter(w, sw), r)
+		sw.setHeader()
 	})
 }
 
@@ -129,99 +130,20 @@ func UUID(h http.Handler) http.Handler {
 }
 
 // BasicAuth protects all requests to the given handler, unless the request has
-// basic auth with a username and password in the users map.
+// basic auth with a username and password in the users map. It is shorthand
+// for BasicAuthWith(h, realm, StaticUsers(users)).
 func BasicAuth(h http.Handler, realm string, users map[string]string) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		user, pass, ok := r.BasicAuth()
-		if !ok {
-			rest.Unauthorized(w, r, realm)
-			return
-		}
-
-		serverPass, ok := users[user]
-		if !ok {
-			if user == "" {
-				rest.Unauthorized(w, r, realm)
-			} else {
-				rest.Forbidden(w, r, &resterror.Error{
-					Title: "Username or password are invalid. Please double check your credentials",
-					ID:    "forbidden",
-				})
-			}
-			return
-		}
-		if subtle.ConstantTimeCompare([]byte(pass), []byte(serverPass)) != 1 {
-			rest.Forbidden(w, r, &resterror.Error{
-				Title:    fmt.Sprintf("Incorrect password for user %s", user),
-				ID:       "incorrect_password",
-				Instance: r.URL.Path,
-			})
-			return
-		}
-		h.ServeHTTP(w, r)
-	})
-}
-
-var envFunc = os.Getenv
-
-// Debug prints debugging information about the request to output if the
-// DEBUG_HTTP_TRAFFIC environment variable is set to "true".
-func DebugWriter(h http.Handler, output io.Writer) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if envFunc("DEBUG_HTTP_TRAFFIC") != "true" && envFunc("DEBUG_HTTP_SERVER_TRAFFIC") != "true" {
-			h.ServeHTTP(w, r)
-			return
-		}
-		// You need to write the entire thing in one Write, otherwise the
-		// output will be jumbled with other requests.
-		b := new(bytes.Buffer)
-		bits, err := httputil.DumpRequest(r, true)
-		if err != nil {
-			_, _ = b.WriteString(err.Error())
-		} else {
-			if w.Header().Get("Content-Encoding") == "gzip" {
-				_, _ = b.WriteString("[binary data omitted]")
-			} else {
-				_, _ = b.Write(bits)
-			}
-		}
-		res := httptest.NewRecorder()
-		h.ServeHTTP(res, r)
-
-		_, _ = b.WriteString(fmt.Sprintf("HTTP/1.1 %d\r\n", res.Code))
-		_ = res.Header().Write(b)
-		maps.Copy(w.Header(), res.Header())
-		w.WriteHeader(res.Code)
-		_, _ = b.WriteString("\r\n")
-		if w.Header().Get("Content-Encoding") == "gzip" {
-			io.WriteString(b, "[binary data omitted]")
-			res.Body.WriteTo(w)
-		} else {
-			writer := io.MultiWriter(w, b)
-			res.Body.WriteTo(writer)
-		}
-		_, _ = b.WriteTo(output)
-	})
-}
-
-// Debug prints debugging information about the request to stderr if the
-// DEBUG_HTTP_TRAFFIC environment variable is set to "true".
-func Debug(h http.Handler) http.Handler {
-	return DebugWriter(h, os.Stderr)
+	return BasicAuthWith(h, realm, StaticUsers(users))
 }
 
 // responseLogger is wrapper of http.ResponseWriter that keeps track of its HTTP
 // status code and body size
 type responseLogger struct {
-	w      http.ResponseWriter
+	baseWriter
 	status int
 	size   int
 }
 
-func (l *responseLogger) Header() http.Header {
-	return l.w.Header()
-}
-
 func (l *responseLogger) Write(b []byte) (int, error) {
 	if l.status == 0 {
 		// The status will be StatusOK if WriteHeader has not been called yet
@@ -232,6 +154,16 @@ func (l *responseLogger) Write(b []byte) (int, error) {
 	return size, err
 }
 
+// ReadFrom implements the io.ReaderFrom interface.
+func (l *responseLogger) ReadFrom(r io.Reader) (int64, error) {
+	if l.status == 0 {
+		l.status = http.StatusOK
+	}
+	n, err := readFrom(l.w, l.w, r)
+	l.size += int(n)
+	return n, err
+}
+
 func (l *responseLogger) WriteHeader(s int) {
 	l.w.WriteHeader(s)
 	l.status = s
@@ -248,52 +180,51 @@ func (l *responseLogger) Size() int {
 	return l.size
 }
 
-func (l *responseLogger) Flush() {
-	f, ok := l.w.(http.Flusher)
-	if ok {
-		f.Flush()
-	}
-}
-
-// Push implements the http.Pusher interface.
-func (l *responseLogger) Push(target string, opts *http.PushOptions) error {
-	return push(l.w, target, opts)
-}
-
-type hijackLogger struct {
-	responseLogger
-}
-
-func makeLogger(w http.ResponseWriter) loggingResponseWriter {
-	var logger loggingResponseWriter = &responseLogger{w: w}
-	if _, ok := w.(http.Hijacker); ok {
-		logger = &hijackLogger{responseLogger{w: w}}
-	}
-	return logger
-}
-
-type loggingResponseWriter interface {
-	http.ResponseWriter
-	http.Flusher
-	Status() int
-	Size() int
-}
-
 func (l logHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	t := time.Now()
-	logWriter := makeLogger(w)
+	logger := &responseLogger{baseWriter: baseWriter{w: w}}
 	u := *r.URL
 	r = r.WithContext(context.WithValue(r.Context(), extraLog, &logHolder{}))
-	l.h.ServeHTTP(logWriter, r)
-	writeLog(l.l, r, u, t, logWriter.Status(), logWriter.Size())
+	l.h.ServeHTTP(wrapWriter(w, logger), r)
+	writeLog(l.l, r, u, t, logger.Status(), logger.Size())
 }
 
+// getRemoteIP returns the client IP address determined by RealIP, if it ran.
+// Otherwise it returns the first address in the X-Forwarded-For header, which
+// can be spoofed by the client, or the address of the peer.
 func getRemoteIP(r *http.Request) string {
+	if ip, ok := GetRealIP(r.Context()); ok {
+		return ip.String()
+	}
+	if holder, ok := r.Context().Value(extraLog).(*logHolder); ok {
+		holder.mu.Lock()
+		addr := holder.remoteAddr
+		holder.mu.Unlock()
+		if addr != "" {
+			return addr
+		}
+	}
 	fwd := r.Header.Get("X-Forwarded-For")
 	if fwd == "" {
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			return host
+		}
 		return r.RemoteAddr
 	}
-	return strings.Split(fwd, ",")[0]
+	return strings.TrimSpace(strings.Split(fwd, ",")[0])
+}
+
+// getLogUser returns the principal authenticated for r, or nil.
+func getLogUser(r *http.Request) *Principal {
+	if p, ok := GetUser(r.Context()); ok {
+		return p
+	}
+	if holder, ok := r.Context().Value(extraLog).(*logHolder); ok {
+		holder.mu.Lock()
+		defer holder.mu.Unlock()
+		return holder.user
+	}
+	return nil
 }
 
 // Return the time since the given time, in ms.
@@ -306,6 +237,12 @@ func timeSinceMs(t time.Time) int64 {
 type logHolder struct {
 	mu   sync.Mutex
 	logs []any
+	// remoteAddr is the client IP determined by RealIP, if it ran inside
+	// the Log handler.
+	remoteAddr string
+	// user is the principal authenticated by an auth middleware, if it ran
+	// inside the Log handler.
+	user *Principal
 }
 
 // Append will append the logctx arguments to the log line for this request.
@@ -339,7 +276,8 @@ func Log(h http.Handler) http.Handler {
 }
 
 // RedirectProto redirects requests with an "X-Forwarded-Proto: http" header to
-// their HTTPS equivalent.
+// their HTTPS equivalent. The header is trusted from any peer; use
+// RedirectProtoWithOptions to restrict it to known proxies.
 func RedirectProto(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Header.Get("X-Forwarded-Proto") == "http" {
@@ -356,7 +294,9 @@ func RedirectProto(h http.Handler) http.Handler {
 	})
 }
 
-// STS sets a Strict-Transport-Security header on the response.
+// STS sets a "max-age=31536000; preload" Strict-Transport-Security header on
+// the response. Use STSWithOptions to configure the header, or to only set it
+// on HTTPS responses.
 func STS(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Strict-Transport-Security", "max-age=31536000; preload")
@@ -33,20 +33,19 @@ func WithLogger(h http.Handler, logger *slog.Logger) http.Handler {
 }
 
 func writeLog(l *slog.Logger, r *http.Request, u url.URL, t time.Time, status int, size int) {
-	user, _, _ := r.BasicAuth()
 	args := []any{
 		"method", r.Method,
 		"path", r.URL.RequestURI(),
 		"time", strconv.FormatInt(timeSinceMs(t), 10),
 		"bytes", strconv.Itoa(size),
 		"status", strconv.Itoa(status),
-		// Set X-Forwarded-For to pass through headers from a proxy.
+		// Use RealIP to resolve the client address from trusted proxy headers.
 		"remote_addr", getRemoteIP(r),
 		"host", r.Host,
 		"user_agent", r.UserAgent(),
 	}
-	if user != "" {
-		args = append(args, "user", user)
+	if user := getLogUser(r); user != nil {
+		args = append(args, "user", user.Username, "auth_method", user.AuthMethod)
 	}
 	if id := r.Header.Get("X-Request-Id"); id != "" {
 		args = append(args, "request_id", id)
@@ -38,3 +38,101 @@ func TestLog(t *testing.T) {
 		t.Errorf("did not log additional data to log: %q", buf.String())
 	}
 }
+
+func TestLogRealIP(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	h := WithLogger(RealIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), PrivateNetworks), logger)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:4567"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, 198.51.100.7")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if !strings.Contains(buf.String(), "remote_addr=198.51.100.7 ") {
+		t.Errorf("did not log resolved client IP: %q", buf.String())
+	}
+}
+
+func TestCSPReportHandlerLogs(t *testing.T) {
+	var buf bytes.Buffer
+	old := Logger
+	Logger = slog.New(slog.NewTextHandler(&buf, nil))
+	defer func() { Logger = old }()
+
+	h := CSPReportHandler()
+	bodies := []string{
+		`{"csp-report": {"document-uri": "https://example.com/a", "effective-directive": "script-src-elem", "blocked-uri": "inline", "disposition": "enforce"}}`,
+		`[{"type": "csp-violation", "body": {"documentURL": "https://example.com/b", "effectiveDirective": "img-src", "blockedURL": "https://evil.example/x.png", "disposition": "report"}}, {"type": "deprecation", "body": {}}]`,
+	}
+	for _, body := range bodies {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/csp-report", strings.NewReader(body)))
+		if w.Code != http.StatusNoContent {
+			t.Errorf("got code %d, want 204", w.Code)
+		}
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"document_uri=https://example.com/a directive=script-src-elem blocked_uri=inline disposition=enforce",
+		"document_uri=https://example.com/b directive=img-src blocked_uri=https://evil.example/x.png disposition=report",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected log to contain %q, got %q", want, out)
+		}
+	}
+	if n := strings.Count(out, "CSP violation"); n != 2 {
+		t.Errorf("expected 2 violations to be logged, got %d", n)
+	}
+}
+
+func TestLogAuthenticatedUser(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	h := WithLogger(BasicAuth(http.NotFoundHandler(), "admin", map[string]string{"bob": "secret"}), logger)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("bob", "secret")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if !strings.Contains(buf.String(), " user=bob auth_method=basic\n") {
+		t.Errorf("did not log authenticated user: %q", buf.String())
+	}
+
+	// Don't log usernames the client sent but didn't prove.
+	buf.Reset()
+	r.SetBasicAuth("mallory", "guess")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if strings.Contains(buf.String(), "user=") {
+		t.Errorf("logged unauthenticated user: %q", buf.String())
+	}
+}
+
+func TestLogTokenUser(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	h := WithLogger(TokenAuth(http.NotFoundHandler(), "api", StaticTokens(map[string]string{"s3cret": "deploy-bot"})), logger)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Api-Key", "s3cret")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if !strings.Contains(buf.String(), " user=deploy-bot auth_method=api_key\n") {
+		t.Errorf("did not log authenticated user: %q", buf.String())
+	}
+}
+
+func TestAuthLimiterLogsLockout(t *testing.T) {
+	var buf bytes.Buffer
+	old := Logger
+	Logger = slog.New(slog.NewTextHandler(&buf, nil))
+	defer func() { Logger = old }()
+
+	attempt(&AuthLimiter{MaxFailures: 1}, "192.0.2.1", "bob", ErrIncorrectPassword)
+	out := buf.String()
+	for _, want := range []string{
+		"kind=ip ip=192.0.2.1 failures=1 lockout=1m0s",
+		"kind=user user=bob failures=1 lockout=1m0s",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected log to contain %q, got %q", want, out)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ProxyHeaders rewrites r.URL.Scheme, r.URL.Host, r.Host and r.RemoteAddr to
+// the values seen by the first proxy in front of the application, for
+// requests from a proxy in trusted (a list of CIDR ranges or IP addresses).
+// Headers from untrusted peers are ignored.
+//
+// The standard Forwarded header (RFC 7239) is used if present: ProxyHeaders
+// walks its elements from right to left, skipping hops added by trusted
+// proxies, and uses the proto, host and for parameters of the first
+// untrusted hop. Otherwise the X-Forwarded-Proto, X-Forwarded-Host,
+// X-Forwarded-Port and X-Forwarded-For headers are used. The client IP is also
+// stored on the request context for GetRealIP and the Log middleware, as with
+// RealIP.
+//
+// ProxyHeaders panics if any of the trusted ranges are invalid.
+func ProxyHeaders(h http.Handler, trusted []string) http.Handler {
+	proxies := trustedProxies(parsePrefixes(trusted))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, proxies.rewrite(r))
+	})
+}
+
+// rewrite returns r, or a copy of r with fields rewritten from proxy headers
+// if r came from a trusted proxy.
+func (t trustedProxies) rewrite(r *http.Request) *http.Request {
+	peer, ok := parseHostAddr(r.RemoteAddr)
+	if !ok || !t.contains(peer) {
+		return r
+	}
+	var proto, host string
+	if fwd := r.Header.Values("Forwarded"); len(fwd) > 0 {
+		elems := parseForwarded(fwd)
+		for i := len(elems) - 1; i >= 0; i-- {
+			proto, host = elems[i]["proto"], elems[i]["host"]
+			addr, ok := parseHostAddr(elems[i]["for"])
+			if !ok || !t.contains(addr) {
+				break
+			}
+		}
+	} else {
+		proto = firstHeaderValue(r.Header.Get("X-Forwarded-Proto"))
+		host = firstHeaderValue(r.Header.Get("X-Forwarded-Host"))
+		if port := firstHeaderValue(r.Header.Get("X-Forwarded-Port")); port != "" {
+			if host == "" {
+				host = r.Host
+			}
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			if !(port == "443" && strings.EqualFold(proto, "https") || port == "80" && strings.EqualFold(proto, "http")) {
+				host = net.JoinHostPort(host, port)
+			}
+		}
+	}
+	ip, _ := t.clientIP(r)
+
+	r2 := withRealIP(r, ip)
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	if proto = strings.ToLower(proto); proto == "http" || proto == "https" {
+		r2.URL.Scheme = proto
+	}
+	if host != "" {
+		r2.Host = host
+		r2.URL.Host = host
+	}
+	r2.RemoteAddr = ip.String()
+	return r2
+}
+
+// firstHeaderValue returns the first entry in a comma separated header value.
+func firstHeaderValue(s string) string {
+	first, _, _ := strings.Cut(s, ",")
+	return strings.TrimSpace(first)
+}
+
+// RedirectProtoOptions configures RedirectProtoWithOptions.
+type RedirectProtoOptions struct {
+	// TrustedProxies lists the CIDR ranges or IP addresses of the proxies
+	// whose headers are used to determine the scheme and host of the
+	// original request, as in ProxyHeaders. If TrustedProxies is empty,
+	// only X-Forwarded-Proto is used, like RedirectProto: the redirect goes
+	// to r.Host, and the request is passed on without being rewritten.
+	TrustedProxies []string
+
+	// StatusCode is the redirect status code, for example
+	// http.StatusMovedPermanently or http.StatusPermanentRedirect. If
+	// StatusCode is zero, http.StatusFound is used.
+	StatusCode int
+
+	// ExcludedPaths lists paths that are never redirected, like a load
+	// balancer's health check. Entries ending in "/" match every path with
+	// that prefix; other entries must match the path exactly.
+	ExcludedPaths []string
+}
+
+// RedirectProtoWithOptions redirects requests that a proxy reports were made
+// over plain HTTP, via the Forwarded or X-Forwarded-Proto headers, to their
+// HTTPS equivalent. With TrustedProxies, the redirect uses the original host
+// reported by the proxy, and the request is rewritten as by ProxyHeaders.
+// RedirectProtoWithOptions panics if any of the trusted ranges are invalid.
+func RedirectProtoWithOptions(h http.Handler, opts RedirectProtoOptions) http.Handler {
+	var proxies trustedProxies
+	if len(opts.TrustedProxies) > 0 {
+		proxies = trustedProxies(parsePrefixes(opts.TrustedProxies))
+	}
+	code := opts.StatusCode
+	if code == 0 {
+		code = http.StatusFound
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var scheme string
+		if proxies == nil {
+			// Without trusted proxies, any client could set the other
+			// headers, so don't use them to rewrite the request or pick
+			// the redirect target.
+			scheme = strings.ToLower(firstHeaderValue(r.Header.Get("X-Forwarded-Proto")))
+		} else {
+			r = proxies.rewrite(r)
+			scheme = r.URL.Scheme
+		}
+		if scheme != "http" || excludedPath(opts.ExcludedPaths, r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		u := *r.URL
+		u.Scheme = "https"
+		u.Host = r.Host
+		http.Redirect(w, r, u.String(), code)
+	})
+}
+
+func excludedPath(excluded []string, path string) bool {
+	for _, e := range excluded {
+		if path == e || strings.HasSuffix(e, "/") && strings.HasPrefix(path, e) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxyHeaders(t *testing.T) {
+	t.Parallel()
+	trusted := []string{"10.0.0.0/8"}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     http.Header
+		scheme     string
+		host       string
+		remote     string
+	}{
+		{"untrusted peer", "203.0.113.5:1234", http.Header{"X-Forwarded-Proto": {"https"}, "X-Forwarded-Host": {"evil.example"}}, "", "example.com", "203.0.113.5:1234"},
+		{"x-forwarded", "10.0.0.1:1234", http.Header{"X-Forwarded-Proto": {"https"}, "X-Forwarded-Host": {"api.example"}, "X-Forwarded-For": {"198.51.100.7"}}, "https", "api.example", "198.51.100.7"},
+		{"x-forwarded-port", "10.0.0.1:1234", http.Header{"X-Forwarded-Proto": {"https"}, "X-Forwarded-Host": {"api.example:80"}, "X-Forwarded-Port": {"8443"}}, "https", "api.example:8443", "10.0.0.1"},
+		{"default port", "10.0.0.1:1234", http.Header{"X-Forwarded-Proto": {"https"}, "X-Forwarded-Port": {"443"}}, "https", "example.com", "10.0.0.1"},
+		{"unknown proto", "10.0.0.1:1234", http.Header{"X-Forwarded-Proto": {"gopher"}}, "", "example.com", "10.0.0.1"},
+		{"forwarded", "10.0.0.1:1234", http.Header{"Forwarded": {`for=1.2.3.4;proto=http;host=spoofed, for=198.51.100.7;proto=https;host="api.example", for=10.1.1.1;proto=http;host=internal`}}, "https", "api.example", "198.51.100.7"},
+	}
+	for _, tt := range tests {
+		var scheme, host, urlHost, remote string
+		h := ProxyHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			scheme, host, urlHost, remote = r.URL.Scheme, r.Host, r.URL.Host, r.RemoteAddr
+		}), trusted)
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		for k, v := range tt.header {
+			req.Header[k] = v
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		if scheme != tt.scheme {
+			t.Errorf("%s: got scheme %q, want %q", tt.name, scheme, tt.scheme)
+		}
+		if host != tt.host {
+			t.Errorf("%s: got host %q, want %q", tt.name, host, tt.host)
+		}
+		if tt.scheme != "" && urlHost != tt.host {
+			t.Errorf("%s: got URL host %q, want %q", tt.name, urlHost, tt.host)
+		}
+		if remote != tt.remote {
+			t.Errorf("%s: got remote addr %q, want %q", tt.name, remote, tt.remote)
+		}
+	}
+}
+
+func TestRedirectProtoWithOptionsUntrusted(t *testing.T) {
+	t.Parallel()
+	var seen *http.Request
+	h := RedirectProtoWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r
+		w.WriteHeader(http.StatusNoContent)
+	}), RedirectProtoOptions{})
+
+	req := httptest.NewRequest("GET", "/x", nil)
+	req.RemoteAddr = "203.0.113.5:1234"
+	req.Header.Set("X-Forwarded-Proto", "http")
+	req.Header.Set("X-Forwarded-Host", "evil.example")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if loc := w.Header().Get("Location"); w.Code != http.StatusFound || loc != "https://example.com/x" {
+		t.Errorf("got %d to %q, want a redirect to the request's own host", w.Code, loc)
+	}
+
+	req = httptest.NewRequest("GET", "/x", nil)
+	req.RemoteAddr = "203.0.113.5:1234"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-For", "6.6.6.6")
+	req.Header.Set("X-Forwarded-Host", "evil.example")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if seen == nil {
+		t.Fatal("handler not called")
+	}
+	if seen.RemoteAddr != "203.0.113.5:1234" || seen.Host != "example.com" {
+		t.Errorf("request rewritten from untrusted headers: RemoteAddr %q, Host %q", seen.RemoteAddr, seen.Host)
+	}
+	if ip, ok := GetRealIP(seen.Context()); ok {
+		t.Errorf("got real IP %v from an untrusted header", ip)
+	}
+	if got := clientAddr(seen); got != "203.0.113.5" {
+		t.Errorf("got client address %q, want the peer address", got)
+	}
+}
+
+func TestRedirectProtoWithOptions(t *testing.T) {
+	t.Parallel()
+	h := RedirectProtoWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}), RedirectProtoOptions{
+		TrustedProxies: []string{"10.0.0.0/8"},
+		StatusCode:     http.StatusPermanentRedirect,
+		ExcludedPaths:  []string{"/healthz", "/internal/"},
+	})
+	tests := []struct {
+		path       string
+		remoteAddr string
+		header     http.Header
+		code       int
+		location   string
+	}{
+		{"/a?b=c", "10.0.0.1:1234", http.Header{"X-Forwarded-Proto": {"http"}, "X-Forwarded-Host": {"api.example"}}, 308, "https://api.example/a?b=c"},
+		{"/a", "10.0.0.1:1234", http.Header{"Forwarded": {"for=198.51.100.7;proto=http"}}, 308, "https://example.com/a"},
+		{"/a", "10.0.0.1:1234", http.Header{"X-Forwarded-Proto": {"https"}}, 204, ""},
+		{"/a", "203.0.113.5:1234", http.Header{"X-Forwarded-Proto": {"http"}}, 204, ""},
+		{"/healthz", "10.0.0.1:1234", http.Header{"X-Forwarded-Proto": {"http"}}, 204, ""},
+		{"/healthz/deep", "10.0.0.1:1234", http.Header{"X-Forwarded-Proto": {"http"}}, 308, "https://example.com/healthz/deep"},
+		{"/internal/status", "10.0.0.1:1234", http.Header{"X-Forwarded-Proto": {"http"}}, 204, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.RemoteAddr = tt.remoteAddr
+		for k, v := range tt.header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%s %v: got code %d, want %d", tt.path, tt.header, w.Code, tt.code)
+		}
+		if loc := w.Header().Get("Location"); loc != tt.location {
+			t.Errorf("%s %v: got Location %q, want %q", tt.path, tt.header, loc, tt.location)
+		}
+	}
+}
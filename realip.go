@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// PrivateNetworks lists the loopback and private address ranges, for use
+// with RealIP when your load balancers run inside a private network.
+var PrivateNetworks = []string{
+	"127.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::1/128",
+	"fc00::/7",
+}
+
+// parsePrefixes parses CIDR ranges or bare IP addresses. It panics if any of
+// them are invalid.
+func parsePrefixes(cidrs []string) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				panic(fmt.Sprintf("handlers: could not parse %q as an IP address: %v", cidr, err))
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			panic(fmt.Sprintf("handlers: could not parse %q as a CIDR range: %v", cidr, err))
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes
+}
+
+// trustedProxies is a set of address ranges whose proxy headers are trusted.
+type trustedProxies []netip.Prefix
+
+func (t trustedProxies) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range t {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// RealIP determines the IP address of the client that made the request, and
+// stores it on the request context, where it can be retrieved with GetRealIP.
+// The Log middleware logs it as the remote_addr.
+//
+// Proxy headers are only trusted if the request came from an address in
+// trusted, a list of CIDR ranges like "10.0.0.0/8" or single IP addresses.
+// RealIP reads the standard Forwarded header (RFC 7239) if present, and
+// X-Forwarded-For otherwise, walking the list of addresses from right to
+// left and returning the first one that is not a trusted proxy; clients can
+// add anything they like to the left of the list, so entries there cannot be
+// trusted. If neither header is present, the X-Real-IP header is used. If
+// the request did not come from a trusted proxy, the client IP is the
+// address of the peer (r.RemoteAddr) without the port.
+//
+// RealIP panics if any of the trusted ranges are invalid.
+func RealIP(h http.Handler, trusted []string) http.Handler {
+	proxies := trustedProxies(parsePrefixes(trusted))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, ok := proxies.clientIP(r)
+		if !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, withRealIP(r, ip))
+	})
+}
+
+// withRealIP returns a shallow copy of r with ip stored on its context, and
+// reports ip to the enclosing Log handler, if any.
+func withRealIP(r *http.Request, ip netip.Addr) *http.Request {
+	if holder, ok := r.Context().Value(extraLog).(*logHolder); ok {
+		holder.mu.Lock()
+		holder.remoteAddr = ip.String()
+		holder.mu.Unlock()
+	}
+	return r.WithContext(context.WithValue(r.Context(), realIP, ip))
+}
+
+// GetRealIP returns the client IP address determined by the RealIP handler,
+// or false if RealIP did not run for this request.
+func GetRealIP(ctx context.Context) (netip.Addr, bool) {
+	ip, ok := ctx.Value(realIP).(netip.Addr)
+	return ip, ok
+}
+
+// clientIP returns the address of the client that made r. It returns false
+// if r.RemoteAddr can't be parsed, for example in tests that don't set it.
+func (t trustedProxies) clientIP(r *http.Request) (netip.Addr, bool) {
+	peer, ok := parseHostAddr(r.RemoteAddr)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	if !t.contains(peer) {
+		return peer.Unmap(), true
+	}
+	var chain []string
+	if fwd := r.Header.Values("Forwarded"); len(fwd) > 0 {
+		for _, elem := range parseForwarded(fwd) {
+			chain = append(chain, elem["for"])
+		}
+	} else if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		for _, line := range xff {
+			for ip := range strings.SplitSeq(line, ",") {
+				chain = append(chain, strings.TrimSpace(ip))
+			}
+		}
+	} else if realIP, ok := parseHostAddr(r.Header.Get("X-Real-IP")); ok {
+		return realIP.Unmap(), true
+	}
+	client := peer
+	for i := len(chain) - 1; i >= 0; i-- {
+		addr, ok := parseHostAddr(chain[i])
+		if !ok {
+			// Obfuscated identifiers like "unknown" or "_hidden" (RFC 7239
+			// section 6.3), or garbage. Use the last address we know.
+			break
+		}
+		client = addr
+		if !t.contains(addr) {
+			break
+		}
+	}
+	return client.Unmap(), true
+}
+
+// parseHostAddr parses an IP address that may have a port attached, like
+// "192.0.2.1:4711" or "[2001:db8::1]:4711", or be in brackets.
+func parseHostAddr(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return netip.Addr{}, false
+	}
+	if addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")); err == nil {
+		return addr, true
+	}
+	host, _, err := net.SplitHostPort(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr, err := netip.ParseAddr(host)
+	return addr, err == nil
+}
+
+// parseForwarded parses the values of Forwarded headers (RFC 7239) into
+// a list of elements, one per proxy hop, with lower cased parameter names
+// and unquoted values.
+func parseForwarded(values []string) []map[string]string {
+	var elems []map[string]string
+	for _, value := range values {
+		for elem := range splitQuoted(value, ',') {
+			params := make(map[string]string)
+			for pair := range splitQuoted(elem, ';') {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok {
+					continue
+				}
+				val = strings.TrimSpace(val)
+				if len(val) >= 2 && val[0] == '"' && val[len(val)-1] == '"' {
+					val = strings.ReplaceAll(val[1:len(val)-1], `\"`, `"`)
+				}
+				params[strings.ToLower(strings.TrimSpace(key))] = val
+			}
+			elems = append(elems, params)
+		}
+	}
+	return elems
+}
+
+// splitQuoted splits s on sep, ignoring separators inside quoted strings.
+func splitQuoted(s string, sep byte) func(yield func(string) bool) {
+	return func(yield func(string) bool) {
+		inQuotes := false
+		start := 0
+		for i := 0; i < len(s); i++ {
+			switch {
+			case s[i] == '\\' && inQuotes:
+				i++
+			case s[i] == '"':
+				inQuotes = !inQuotes
+			case s[i] == sep && !inQuotes:
+				if !yield(s[start:i]) {
+					return
+				}
+				start = i + 1
+			}
+		}
+		yield(s[start:])
+	}
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRealIP(t *testing.T) {
+	t.Parallel()
+	trusted := []string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     http.Header
+		want       string
+	}{
+		{"no proxy", "203.0.113.5:1234", nil, "203.0.113.5"},
+		{"untrusted peer ignores headers", "203.0.113.5:1234", http.Header{"X-Forwarded-For": {"1.2.3.4"}}, "203.0.113.5"},
+		{"trusted peer", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.7"}}, "198.51.100.7"},
+		{"spoofed left entry", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"1.2.3.4, 198.51.100.7, 10.1.1.1"}}, "198.51.100.7"},
+		{"multiple headers", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"1.2.3.4", "198.51.100.7, 192.0.2.1"}}, "198.51.100.7"},
+		{"all trusted", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"10.2.2.2, 10.1.1.1"}}, "10.2.2.2"},
+		{"forwarded", "10.0.0.1:1234", http.Header{"Forwarded": {`for=1.2.3.4, for="198.51.100.7:4711";proto=https`}}, "198.51.100.7"},
+		{"forwarded ipv6", "[2001:db8::1]:1234", http.Header{"Forwarded": {`for="[2001:4860::8888]:4711"`}}, "2001:4860::8888"},
+		{"forwarded beats xff", "10.0.0.1:1234", http.Header{"Forwarded": {"for=198.51.100.7"}, "X-Forwarded-For": {"1.2.3.4"}}, "198.51.100.7"},
+		{"forwarded obfuscated", "10.0.0.1:1234", http.Header{"Forwarded": {"for=unknown, for=10.3.3.3"}}, "10.3.3.3"},
+		{"x-real-ip", "10.0.0.1:1234", http.Header{"X-Real-Ip": {"198.51.100.7"}}, "198.51.100.7"},
+		{"untrusted x-real-ip", "203.0.113.5:1234", http.Header{"X-Real-Ip": {"198.51.100.7"}}, "203.0.113.5"},
+		{"mapped ipv4", "[::ffff:10.0.0.1]:1234", http.Header{"X-Forwarded-For": {"198.51.100.7"}}, "198.51.100.7"},
+	}
+	for _, tt := range tests {
+		var got string
+		h := RealIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip, ok := GetRealIP(r.Context())
+			if !ok {
+				t.Errorf("%s: no IP set on context", tt.name)
+			}
+			got = ip.String()
+		}), trusted)
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		for k, v := range tt.header {
+			req.Header[k] = v
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRealIPInvalidRange(t *testing.T) {
+	t.Parallel()
+	defer func() {
+		if recover() == nil {
+			t.Error("expected RealIP to panic with an invalid range")
+		}
+	}()
+	RealIP(http.NotFoundHandler(), []string{"10.0.0.0/99"})
+}
+
+func TestGetRemoteIPStripsPort(t *testing.T) {
+	t.Parallel()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "203.0.113.5:1234"
+	if ip := getRemoteIP(req); ip != "203.0.113.5" {
+		t.Errorf("expected port to be stripped, got %q", ip)
+	}
+}
@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kevinburke/rest/v2"
+	"github.com/kevinburke/rest/v2/resterror"
+)
+
+// Record serves requests with h, and saves each request and response to
+// a fixture file in dir, in the same HTTP wire format used by Debug. Serve
+// the fixtures with Replay to build hermetic tests against a recorded
+// upstream service. Request and response headers listed in
+// DefaultDebugRedactHeaders, like Cookie and Set-Cookie, are redacted in the
+// fixture files.
+//
+// Fixtures are named after the request method, path, query string and
+// a hash of the normalized request body; a later request with the same key
+// overwrites the earlier fixture.
+func Record(h http.Handler, dir string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqBody := &cappedBuffer{max: -1}
+		var tee *teeReadCloser
+		if r.Body != nil && r.Body != http.NoBody {
+			r2 := r.WithContext(r.Context())
+			tee = &teeReadCloser{ReadCloser: r.Body, w: reqBody}
+			r2.Body = tee
+			r = r2
+		}
+		dw := &debugWriter{baseWriter: baseWriter{w: w}, body: cappedBuffer{max: -1}}
+		h.ServeHTTP(wrapWriter(w, dw), r)
+		if dw.hijacked {
+			return
+		}
+		if tee != nil {
+			io.Copy(io.Discard, tee)
+		}
+		if dw.header == nil {
+			dw.snapshot(http.StatusOK)
+		}
+		if err := writeFixture(dir, r, reqBody.buf.Bytes(), dw); err != nil {
+			Logger.Error("could not record fixture", "method", r.Method, "path", r.URL.Path, "err", err)
+		}
+	})
+}
+
+func writeFixture(dir string, r *http.Request, reqBody []byte, dw *debugWriter) error {
+	buf := new(bytes.Buffer)
+	dumpReq := r.WithContext(r.Context())
+	dumpReq.Header = redactHeader(r.Header, DefaultDebugRedactHeaders).Clone()
+	dumpReq.Header.Del("Transfer-Encoding")
+	dumpReq.TransferEncoding = nil
+	dumpReq.Header.Set("Content-Length", strconv.Itoa(len(reqBody)))
+	dumpReq.ContentLength = int64(len(reqBody))
+	dumpReq.Body = io.NopCloser(bytes.NewReader(reqBody))
+	reqDump, err := httputil.DumpRequest(dumpReq, true)
+	if err != nil {
+		return err
+	}
+	buf.Write(reqDump)
+
+	respBody := dw.body.buf.Bytes()
+	header := redactHeader(dw.header, DefaultDebugRedactHeaders).Clone()
+	header.Del("Transfer-Encoding")
+	header.Del("Content-Length")
+	resp := &http.Response{
+		StatusCode:    dw.status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		ContentLength: int64(len(respBody)),
+		Body:          io.NopCloser(bytes.NewReader(respBody)),
+	}
+	if err := resp.Write(buf); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, fixtureName(r, reqBody)), buf.Bytes(), 0o644)
+}
+
+// Replay serves the fixtures recorded by Record in dir. Each request is
+// matched to a fixture by its method, path, query string and normalized
+// body; requests without a matching fixture get a 404 error. Replay reads the
+// fixture file on every request, so fixtures can be added or edited while
+// it's running.
+func Replay(dir string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body []byte
+		if r.Body != nil {
+			var err error
+			body, err = io.ReadAll(r.Body)
+			if err != nil {
+				rest.BadRequest(w, r, &resterror.Error{
+					Title:    fmt.Sprintf("Could not read request body: %v", err),
+					ID:       "invalid_request_body",
+					Instance: r.URL.Path,
+				})
+				return
+			}
+		}
+		f, err := os.Open(filepath.Join(dir, fixtureName(r, body)))
+		if err != nil {
+			writeError(w, r, http.StatusNotFound, &resterror.Error{
+				Title: fmt.Sprintf("No fixture recorded for %s %s", r.Method, r.URL.RequestURI()),
+				ID:    "fixture_not_found",
+			})
+			return
+		}
+		defer f.Close()
+		br := bufio.NewReader(f)
+		req, err := http.ReadRequest(br)
+		if err == nil {
+			_, err = io.Copy(io.Discard, req.Body)
+		}
+		var resp *http.Response
+		if err == nil {
+			resp, err = http.ReadResponse(br, req)
+		}
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, &resterror.Error{
+				Title: fmt.Sprintf("Could not parse fixture %s: %v", f.Name(), err),
+				ID:    "invalid_fixture",
+			})
+			return
+		}
+		defer resp.Body.Close()
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		if resp.ContentLength >= 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	})
+}
+
+// fixtureName returns the file name for the fixture matching r and body.
+func fixtureName(r *http.Request, body []byte) string {
+	key := r.Method + " " + r.URL.Path
+	if q := r.URL.Query(); len(q) > 0 {
+		// Encode sorts by key.
+		key += "?" + q.Encode()
+	}
+	h := sha256.New()
+	io.WriteString(h, key)
+	h.Write([]byte{0})
+	h.Write(normalizeBody(r.Header.Get("Content-Type"), body))
+	slug := strings.Map(func(c rune) rune {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' {
+			return c
+		}
+		return '_'
+	}, strings.Trim(r.URL.Path, "/"))
+	if len(slug) > 64 {
+		slug = slug[:64]
+	}
+	return fmt.Sprintf("%s_%s_%s.http", r.Method, slug, hex.EncodeToString(h.Sum(nil))[:16])
+}
+
+// normalizeBody returns a canonical form of body, so that semantically equal
+// JSON or form bodies map to the same fixture.
+func normalizeBody(contentType string, body []byte) []byte {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		var v any
+		if err := json.Unmarshal(body, &v); err == nil {
+			// Marshal sorts map keys and removes insignificant whitespace.
+			if b, err := json.Marshal(v); err == nil {
+				return b
+			}
+		}
+	case mediaType == "application/x-www-form-urlencoded":
+		if v, err := url.ParseQuery(string(body)); err == nil {
+			return []byte(v.Encode())
+		}
+	}
+	return bytes.TrimSpace(body)
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRecordReplay(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Upstream", "true")
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "supersecret"})
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"method": "`+r.Method+`", "body": `+string(body)+`}`)
+	})
+	rec := Record(upstream, dir)
+
+	req := httptest.NewRequest("POST", "/v1/users?b=2&a=1", strings.NewReader(`{"name": "kevin", "age": 30}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer secret-token")
+	w := httptest.NewRecorder()
+	rec.ServeHTTP(w, req)
+	want := `{"method": "POST", "body": {"name": "kevin", "age": 30}}`
+	if w.Code != 201 || w.Body.String() != want {
+		t.Fatalf("bad response from recorder: %d %q", w.Code, w.Body.String())
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 fixture, got %d", len(entries))
+	}
+	fixture, _ := os.ReadFile(dir + "/" + entries[0].Name())
+	if strings.Contains(string(fixture), "secret-token") {
+		t.Errorf("fixture contains Authorization header: %q", fixture)
+	}
+	if strings.Contains(string(fixture), "supersecret") || !strings.Contains(string(fixture), "Set-Cookie: [REDACTED]\r\n") {
+		t.Errorf("fixture contains Set-Cookie header: %q", fixture)
+	}
+	if w.Header().Get("Set-Cookie") != "session=supersecret" {
+		t.Errorf("Set-Cookie sent to the client was redacted: %q", w.Header().Get("Set-Cookie"))
+	}
+
+	replay := Replay(dir)
+	// Same request with differently ordered JSON keys, whitespace and query
+	// parameters.
+	req = httptest.NewRequest("POST", "/v1/users?a=1&b=2", strings.NewReader(`{"age":30,"name":"kevin"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	replay.ServeHTTP(w, req)
+	if w.Code != 201 {
+		t.Fatalf("expected replayed 201, got %d: %s", w.Code, w.Body.String())
+	}
+	if w.Body.String() != want {
+		t.Errorf("wrong replayed body: %q", w.Body.String())
+	}
+	if w.Header().Get("X-Upstream") != "true" {
+		t.Errorf("replay lost headers: %v", w.Header())
+	}
+
+	req = httptest.NewRequest("POST", "/v1/users?a=1&b=2", strings.NewReader(`{"name":"other"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	replay.ServeHTTP(w, req)
+	if w.Code != 404 {
+		t.Errorf("expected 404 for unrecorded request, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "fixture_not_found") {
+		t.Errorf("bad error body: %s", w.Body.String())
+	}
+}
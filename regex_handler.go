@@ -1,9 +1,11 @@
 package handlers
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"regexp"
+	"slices"
 	"strings"
 
 	"github.com/kevinburke/rest/v2"
@@ -75,6 +77,38 @@ var allMethods = []string{
 	"TRACE",
 }
 
+// AllowedMethods returns the HTTP methods accepted by the routes that match
+// path, in the order they were registered, or nil if no route matches. HEAD is
+// included if GET is, and a route registered with nil methods accepts every
+// method. OPTIONS is not included.
+func (h *Regexp) AllowedMethods(path string) []string {
+	var allowed []string
+	seen := make(map[string]bool)
+	add := func(method string) {
+		if !seen[method] {
+			seen[method] = true
+			allowed = append(allowed, method)
+		}
+	}
+	for _, route := range h.routes {
+		if !route.pattern.MatchString(path) {
+			continue
+		}
+		methods := route.methods
+		if methods == nil {
+			methods = allMethods
+		}
+		for _, method := range methods {
+			upper := strings.ToUpper(method)
+			add(upper)
+			if upper == "GET" {
+				add("HEAD")
+			}
+		}
+	}
+	return allowed
+}
+
 // ServeHTTP checks all registered routes in turn for a match, and calls
 // handler.ServeHTTP on the first matching handler. If no routes match,
 // StatusMethodNotAllowed will be rendered.
@@ -83,16 +117,16 @@ func (h *Regexp) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	allowed := make([]string, 0)
 	oneMatch := false
 	for _, route := range h.routes {
-		if route.pattern.MatchString(r.URL.Path) {
+		if matches := route.pattern.FindStringSubmatch(r.URL.Path); matches != nil {
 			oneMatch = true
 			if route.methods == nil && upperMethod != "OPTIONS" {
-				route.handler.ServeHTTP(w, r)
+				route.handler.ServeHTTP(w, setParams(r, route.pattern, matches))
 				return
 			}
 			for _, method := range route.methods {
 				upper := strings.ToUpper(method)
 				if upper == upperMethod || upperMethod == "HEAD" && upper == "GET" {
-					route.handler.ServeHTTP(w, r)
+					route.handler.ServeHTTP(w, setParams(r, route.pattern, matches))
 					return
 				}
 			}
@@ -117,3 +151,74 @@ func (h *Regexp) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		rest.NotFound(w, r)
 	}
 }
+
+type params struct {
+	names  []string
+	values []string
+}
+
+// setParams stores the submatches of pattern on the request context, and sets
+// a path value (see http.Request.PathValue) for every named capture group.
+// Params and path values set by an outer Regexp are replaced, even if pattern
+// has no capture groups.
+func setParams(r *http.Request, pattern *regexp.Regexp, matches []string) *http.Request {
+	p := &params{names: pattern.SubexpNames()}
+	if len(matches) > 1 {
+		p.values = matches
+	}
+	var names []string
+	for _, name := range p.names {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	if outer, ok := r.Context().Value(pathParams).(*params); ok {
+		for _, name := range outer.names {
+			if name != "" && !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	ctx := context.WithValue(r.Context(), pathParams, p)
+	if len(names) == 0 {
+		return r.WithContext(ctx)
+	}
+	// Clone rather than WithContext: a shallow copy shares its path values
+	// with the caller's request, and SetPathValue would overwrite them.
+	r = r.Clone(ctx)
+	for _, name := range names {
+		r.SetPathValue(name, Param(r, name))
+	}
+	return r
+}
+
+// Param returns the value of the named capture group in the Regexp route that
+// matched r, or the empty string if no such group exists. For example, if
+// a route was registered with the pattern `^/v1/jobs/(?P<JobName>[^\s\/]+)$`,
+// Param(r, "JobName") returns "build" for a request to "/v1/jobs/build".
+//
+// Named capture groups are also available via r.PathValue.
+func Param(r *http.Request, name string) string {
+	p, ok := r.Context().Value(pathParams).(*params)
+	if !ok || name == "" {
+		return ""
+	}
+	for i, n := range p.names {
+		if n == name {
+			return p.values[i]
+		}
+	}
+	return ""
+}
+
+// Params returns every submatch of the Regexp route that matched r, named or
+// not, in the order they appear in the pattern. As with
+// regexp.FindStringSubmatch, the first element is the text of the entire
+// match. Params returns nil if the route has no capture groups.
+func Params(r *http.Request) []string {
+	p, ok := r.Context().Value(pathParams).(*params)
+	if !ok {
+		return nil
+	}
+	return p.values
+}
@@ -112,3 +112,109 @@ func TestOptionsNil(t *testing.T) {
 		t.Errorf("Expected ALLOW header to contain list of methods, got %q", w.Header().Get("Allow"))
 	}
 }
+
+func TestParams(t *testing.T) {
+	t.Parallel()
+	route := regexp.MustCompile(`^/v1/jobs/(?P<JobName>[^\s\/]+)/builds/([0-9]+)$`)
+
+	h := new(Regexp)
+	h.HandleFunc(route, []string{"GET"}, func(w http.ResponseWriter, r *http.Request) {
+		if name := Param(r, "JobName"); name != "deploy" {
+			t.Errorf("expected JobName param to equal %q, got %q", "deploy", name)
+		}
+		if name := r.PathValue("JobName"); name != "deploy" {
+			t.Errorf("expected JobName path value to equal %q, got %q", "deploy", name)
+		}
+		if unknown := Param(r, "unknown"); unknown != "" {
+			t.Errorf("expected unknown param to be empty, got %q", unknown)
+		}
+		params := Params(r)
+		if len(params) != 3 {
+			t.Fatalf("expected 3 params, got %d: %q", len(params), params)
+		}
+		if params[1] != "deploy" || params[2] != "12" {
+			t.Errorf("bad positional params: %q", params)
+		}
+		io.WriteString(w, "Hello World!")
+	})
+	req := httptest.NewRequest("GET", "/v1/jobs/deploy/builds/12", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+}
+
+func TestParamsDoNotMutateCaller(t *testing.T) {
+	t.Parallel()
+	h := new(Regexp)
+	h.HandleStringFunc(`^/v1/jobs/(?P<JobName>[^/]+)$`, nil, func(w http.ResponseWriter, r *http.Request) {
+		if name := r.PathValue("JobName"); name != "deploy" {
+			t.Errorf("expected JobName path value to equal %q, got %q", "deploy", name)
+		}
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/{rest...}", func(w http.ResponseWriter, r *http.Request) {
+		r.SetPathValue("JobName", "outer")
+		h.ServeHTTP(w, r)
+		if name := r.PathValue("JobName"); name != "outer" {
+			t.Errorf("router changed the caller's JobName path value to %q", name)
+		}
+		if rest := r.PathValue("rest"); rest != "jobs/deploy" {
+			t.Errorf("router changed the caller's rest path value to %q", rest)
+		}
+	})
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/jobs/deploy", nil))
+}
+
+func TestParamsNested(t *testing.T) {
+	t.Parallel()
+	inner := new(Regexp)
+	called := false
+	inner.HandleStringFunc(`^/a/static$`, nil, func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		if p := Params(r); p != nil {
+			t.Errorf("expected nil params for a route without capture groups, got %q", p)
+		}
+		if id := Param(r, "id"); id != "" {
+			t.Errorf("inner route saw the outer id param %q", id)
+		}
+		if id := r.PathValue("id"); id != "" {
+			t.Errorf("inner route saw the outer id path value %q", id)
+		}
+	})
+	outer := new(Regexp)
+	outer.Handle(regexp.MustCompile(`^/(?P<id>[^/]+)/`), nil, inner)
+	outer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/a/static", nil))
+	if !called {
+		t.Fatal("inner route not called")
+	}
+}
+
+func TestParamsNoMatch(t *testing.T) {
+	t.Parallel()
+	req := httptest.NewRequest("GET", "/v1", nil)
+	if p := Param(req, "JobName"); p != "" {
+		t.Errorf("expected empty param, got %q", p)
+	}
+	if p := Params(req); p != nil {
+		t.Errorf("expected nil params, got %q", p)
+	}
+}
+
+func TestAllowedMethods(t *testing.T) {
+	t.Parallel()
+	h := new(Regexp)
+	h.HandleString(`^/jobs$`, []string{"GET", "post"}, http.NotFoundHandler())
+	h.HandleString(`^/jobs`, []string{"POST", "DELETE"}, http.NotFoundHandler())
+	h.HandleString(`^/any$`, nil, http.NotFoundHandler())
+	if got, want := strings.Join(h.AllowedMethods("/jobs"), ","), "GET,HEAD,POST,DELETE"; got != want {
+		t.Errorf("/jobs: got %q, want %q", got, want)
+	}
+	if got, want := strings.Join(h.AllowedMethods("/any"), ","), "GET,HEAD,POST,PUT,PATCH,DELETE,CONNECT,TRACE"; got != want {
+		t.Errorf("/any: got %q, want %q", got, want)
+	}
+	if got := h.AllowedMethods("/missing"); got != nil {
+		t.Errorf("/missing: expected nil, got %q", got)
+	}
+}
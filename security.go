@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultSTSMaxAge is the max-age used by STSWithOptions if none is set.
+const DefaultSTSMaxAge = 365 * 24 * time.Hour
+
+// STSOptions configures the Strict-Transport-Security header set by
+// STSWithOptions and SecureHeaders.
+type STSOptions struct {
+	// MaxAge is how long browsers should remember to only use HTTPS. It is
+	// rounded down to the second. If MaxAge is zero, DefaultSTSMaxAge is
+	// used; set it to a negative value to send max-age=0, which tells
+	// browsers to forget the policy.
+	MaxAge time.Duration
+
+	// IncludeSubDomains applies the policy to every subdomain of the host.
+	IncludeSubDomains bool
+
+	// Preload asks for the host to be added to the browser preload lists.
+	// The lists require IncludeSubDomains and a MaxAge of at least a year;
+	// see https://hstspreload.org.
+	Preload bool
+
+	// TLSOnly only sets the header on requests made over HTTPS. Browsers
+	// ignore the header on plain HTTP responses. A request counts as HTTPS
+	// if it arrived over TLS, or ProxyHeaders set its scheme to https.
+	TLSOnly bool
+}
+
+func (o STSOptions) value() string {
+	maxAge := o.MaxAge
+	if maxAge == 0 {
+		maxAge = DefaultSTSMaxAge
+	} else if maxAge < 0 {
+		maxAge = 0
+	}
+	var b strings.Builder
+	b.WriteString("max-age=")
+	b.WriteString(strconv.FormatInt(int64(maxAge/time.Second), 10))
+	if o.IncludeSubDomains {
+		b.WriteString("; includeSubDomains")
+	}
+	if o.Preload {
+		b.WriteString("; preload")
+	}
+	return b.String()
+}
+
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.URL.Scheme == "https"
+}
+
+// STSWithOptions sets a Strict-Transport-Security header, configured by opts,
+// on the response.
+func STSWithOptions(h http.Handler, opts STSOptions) http.Handler {
+	value := opts.value()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !opts.TLSOnly || isHTTPS(r) {
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// SecureHeadersOptions configures the headers set by SecureHeaders. Headers
+// with an empty value are not set.
+type SecureHeadersOptions struct {
+	// ContentTypeOptions is the X-Content-Type-Options value.
+	ContentTypeOptions string
+	// FrameOptions is the X-Frame-Options value.
+	FrameOptions string
+	// ReferrerPolicy is the Referrer-Policy value.
+	ReferrerPolicy string
+	// PermissionsPolicy is the Permissions-Policy value.
+	PermissionsPolicy string
+	// CrossOriginOpenerPolicy is the Cross-Origin-Opener-Policy value.
+	CrossOriginOpenerPolicy string
+	// CrossOriginResourcePolicy is the Cross-Origin-Resource-Policy value.
+	CrossOriginResourcePolicy string
+	// CrossOriginEmbedderPolicy is the Cross-Origin-Embedder-Policy value.
+	CrossOriginEmbedderPolicy string
+
+	// STS configures the Strict-Transport-Security header. If STS is nil,
+	// the header is not set.
+	STS *STSOptions
+}
+
+// DefaultSecureHeaders are the headers set by SecureHeaders if no options are
+// given. They suit an application that is not embedded in other sites' frames
+// and does not need cross-origin access to its resources. Copy and modify
+// them to relax individual headers.
+var DefaultSecureHeaders = SecureHeadersOptions{
+	ContentTypeOptions:        "nosniff",
+	FrameOptions:              "DENY",
+	ReferrerPolicy:            "strict-origin-when-cross-origin",
+	PermissionsPolicy:         "camera=(), microphone=(), geolocation=(), payment=(), usb=()",
+	CrossOriginOpenerPolicy:   "same-origin",
+	CrossOriginResourcePolicy: "same-origin",
+	STS:                       &STSOptions{IncludeSubDomains: true, TLSOnly: true},
+}
+
+// SecureHeaders sets security related headers on the response, configured by
+// opts. If opts is nil, DefaultSecureHeaders is used. The headers are set
+// before h is called, so h can override them for individual responses.
+func SecureHeaders(h http.Handler, opts *SecureHeadersOptions) http.Handler {
+	if opts == nil {
+		opts = &DefaultSecureHeaders
+	}
+	headers := make(http.Header)
+	for name, value := range map[string]string{
+		"X-Content-Type-Options":       opts.ContentTypeOptions,
+		"X-Frame-Options":              opts.FrameOptions,
+		"Referrer-Policy":              opts.ReferrerPolicy,
+		"Permissions-Policy":           opts.PermissionsPolicy,
+		"Cross-Origin-Opener-Policy":   opts.CrossOriginOpenerPolicy,
+		"Cross-Origin-Resource-Policy": opts.CrossOriginResourcePolicy,
+		"Cross-Origin-Embedder-Policy": opts.CrossOriginEmbedderPolicy,
+	} {
+		if value != "" {
+			headers.Set(name, value)
+		}
+	}
+	sts, stsTLSOnly := "", false
+	if opts.STS != nil {
+		sts, stsTLSOnly = opts.STS.value(), opts.STS.TLSOnly
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hdr := w.Header()
+		for name, values := range headers {
+			hdr[name] = []string{values[0]}
+		}
+		if sts != "" && (!stsTLSOnly || isHTTPS(r)) {
+			hdr.Set("Strict-Transport-Security", sts)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSTSOptions(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		opts STSOptions
+		want string
+	}{
+		{STSOptions{}, "max-age=31536000"},
+		{STSOptions{MaxAge: time.Hour, IncludeSubDomains: true}, "max-age=3600; includeSubDomains"},
+		{STSOptions{IncludeSubDomains: true, Preload: true}, "max-age=31536000; includeSubDomains; preload"},
+		{STSOptions{MaxAge: -1}, "max-age=0"},
+	}
+	for _, tt := range tests {
+		if got := tt.opts.value(); got != tt.want {
+			t.Errorf("%+v: got %q, want %q", tt.opts, got, tt.want)
+		}
+	}
+}
+
+func TestSTSWithOptionsTLSOnly(t *testing.T) {
+	t.Parallel()
+	h := STSWithOptions(http.NotFoundHandler(), STSOptions{TLSOnly: true})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if hdr := w.Header().Get("Strict-Transport-Security"); hdr != "" {
+		t.Errorf("expected no header on plain HTTP, got %q", hdr)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.TLS = &tls.ConnectionState{}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if hdr := w.Header().Get("Strict-Transport-Security"); hdr != "max-age=31536000" {
+		t.Errorf("got header %q over TLS", hdr)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	w = httptest.NewRecorder()
+	ProxyHeaders(h, PrivateNetworks).ServeHTTP(w, req)
+	if hdr := w.Header().Get("Strict-Transport-Security"); hdr != "max-age=31536000" {
+		t.Errorf("got header %q behind a TLS terminating proxy", hdr)
+	}
+}
+
+func TestSecureHeaders(t *testing.T) {
+	t.Parallel()
+	h := SecureHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+	}), nil)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.TLS = &tls.ConnectionState{}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	want := map[string]string{
+		"X-Content-Type-Options":       "nosniff",
+		"X-Frame-Options":              "SAMEORIGIN",
+		"Referrer-Policy":              "strict-origin-when-cross-origin",
+		"Cross-Origin-Opener-Policy":   "same-origin",
+		"Cross-Origin-Resource-Policy": "same-origin",
+		"Cross-Origin-Embedder-Policy": "",
+		"Strict-Transport-Security":    "max-age=31536000; includeSubDomains",
+	}
+	for name, value := range want {
+		if got := w.Header().Get(name); got != value {
+			t.Errorf("%s: got %q, want %q", name, got, value)
+		}
+	}
+
+	opts := DefaultSecureHeaders
+	opts.FrameOptions = ""
+	opts.STS = nil
+	w = httptest.NewRecorder()
+	SecureHeaders(http.NotFoundHandler(), &opts).ServeHTTP(w, req)
+	if got := w.Header().Get("X-Frame-Options"); got != "" {
+		t.Errorf("expected no X-Frame-Options header, got %q", got)
+	}
+	if got := w.Header().Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("expected no Strict-Transport-Security header, got %q", got)
+	}
+	if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("got X-Content-Type-Options %q", got)
+	}
+}
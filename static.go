@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// precompressedVariant is a sibling file holding a precompressed copy of
+// a static asset.
+type precompressedVariant struct {
+	coding    string
+	extension string
+}
+
+// precompressedVariants are listed in order of preference.
+var precompressedVariants = []precompressedVariant{
+	{"br", ".br"},
+	{"zstd", ".zst"},
+	{"gzip", ".gz"},
+}
+
+// PrecompressedFileServer serves static files from fsys, like
+// http.FileServerFS. If a file has a precompressed sibling, for example
+// "app.js.br" or "app.js.gz" next to "app.js", and the client accepts that
+// encoding via the Accept-Encoding header, the sibling is served instead with
+// the appropriate Content-Encoding header. Brotli (".br") is preferred over
+// Zstandard (".zst"), which is preferred over gzip (".gz").
+//
+// Files without an acceptable precompressed variant are compressed on the fly
+// with the Compress handler, configured with opts, which may be nil.
+func PrecompressedFileServer(fsys fs.FS, opts *CompressOptions) http.Handler {
+	plain := http.FileServerFS(fsys)
+	fallback := Compress(plain, opts)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		if strings.HasSuffix(r.URL.Path, "/") {
+			name = path.Join(name, "index.html")
+		}
+		if name == "" || name == "." {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+
+		available := make([]string, 0, len(precompressedVariants))
+		for _, v := range precompressedVariants {
+			if fi, err := fs.Stat(fsys, name+v.extension); err == nil && fi.Mode().IsRegular() {
+				available = append(available, v.coding)
+			}
+		}
+		if len(available) == 0 {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		coding := negotiateEncoding(r.Header.Get("Accept-Encoding"), available)
+		if coding == "" {
+			// The client doesn't want any of the precompressed variants,
+			// but may still accept one we can compress on the fly, for
+			// example gzip when only a ".br" file was built.
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		var ext string
+		for _, v := range precompressedVariants {
+			if v.coding == coding {
+				ext = v.extension
+			}
+		}
+		if !servePrecompressed(w, r, fsys, name, name+ext, coding) {
+			fallback.ServeHTTP(w, r)
+		}
+	})
+}
+
+// servePrecompressed serves the file at variant as the encoded representation
+// of name. It returns false if variant could not be read.
+func servePrecompressed(w http.ResponseWriter, r *http.Request, fsys fs.FS, name, variant, coding string) bool {
+	f, err := fsys.Open(variant)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return false
+		}
+		content = bytes.NewReader(data)
+	}
+	// Set the Content-Type from the original name, otherwise ServeContent
+	// would guess "application/gzip" or sniff the compressed bytes.
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.Header().Set("Content-Encoding", coding)
+	w.Header().Add("Vary", "Accept-Encoding")
+	http.ServeContent(w, r, name, fi.ModTime(), content)
+	return true
+}
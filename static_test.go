@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+)
+
+func TestPrecompressedFileServer(t *testing.T) {
+	t.Parallel()
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(responseBody)
+	gw.Close()
+	fsys := fstest.MapFS{
+		"app.js":            {Data: responseBody},
+		"app.js.gz":         {Data: gz.Bytes()},
+		"app.js.br":         {Data: []byte("brotli data")},
+		"style.css":         {Data: responseBody},
+		"only-gzip.html":    {Data: responseBody},
+		"only-gzip.html.gz": {Data: gz.Bytes()},
+		"only-br.js":        {Data: responseBody},
+		"only-br.js.br":     {Data: []byte("brotli data")},
+	}
+	h := PrecompressedFileServer(fsys, nil)
+
+	tests := []struct {
+		path           string
+		acceptEncoding string
+		wantEncoding   string
+		wantType       string
+		wantBody       []byte
+	}{
+		{"/app.js", "gzip, br", "br", "text/javascript; charset=utf-8", []byte("brotli data")},
+		{"/app.js", "gzip", "gzip", "text/javascript; charset=utf-8", gz.Bytes()},
+		{"/app.js", "br;q=0.5, gzip", "gzip", "text/javascript; charset=utf-8", gz.Bytes()},
+		{"/app.js", "", "", "text/javascript; charset=utf-8", responseBody},
+		{"/only-gzip.html", "br", "", "text/html; charset=utf-8", responseBody},
+		{"/style.css", "gzip", "gzip", "text/css; charset=utf-8", nil},
+		{"/only-br.js", "gzip", "gzip", "text/javascript; charset=utf-8", nil},
+		{"/only-br.js", "br", "br", "text/javascript; charset=utf-8", []byte("brotli data")},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		if tt.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Errorf("%s %q: expected 200, got %d", tt.path, tt.acceptEncoding, w.Code)
+			continue
+		}
+		if enc := w.Header().Get("Content-Encoding"); enc != tt.wantEncoding {
+			t.Errorf("%s %q: wrong Content-Encoding, got %q want %q", tt.path, tt.acceptEncoding, enc, tt.wantEncoding)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != tt.wantType {
+			t.Errorf("%s %q: wrong Content-Type, got %q want %q", tt.path, tt.acceptEncoding, ct, tt.wantType)
+		}
+		if vary := w.Header().Values("Vary"); len(vary) != 1 || vary[0] != "Accept-Encoding" {
+			t.Errorf("%s %q: wrong Vary header, got %q", tt.path, tt.acceptEncoding, vary)
+		}
+		if tt.wantBody != nil && !bytes.Equal(w.Body.Bytes(), tt.wantBody) {
+			t.Errorf("%s %q: wrong body, got %q", tt.path, tt.acceptEncoding, w.Body.String())
+		}
+		if tt.wantBody == nil {
+			// compressed on the fly
+			zr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(zr)
+			if !bytes.Equal(body, responseBody) {
+				t.Errorf("%s: wrong decompressed body", tt.path)
+			}
+		}
+	}
+}
+
+func TestPrecompressedFileServerNotFound(t *testing.T) {
+	t.Parallel()
+	h := PrecompressedFileServer(fstest.MapFS{}, nil)
+	req := httptest.NewRequest("GET", "/missing.js", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", w.Code)
+	}
+}
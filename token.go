@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/kevinburke/rest/v2"
+	"github.com/kevinburke/rest/v2/resterror"
+)
+
+// Errors returned by a TokenValidator for bad tokens.
+var (
+	// ErrInvalidToken means the token is unknown, expired, revoked or
+	// malformed.
+	ErrInvalidToken = errors.New("handlers: invalid token")
+	// ErrInsufficientScope means the token is valid, but does not grant
+	// access to the requested resource.
+	ErrInsufficientScope = errors.New("handlers: insufficient scope")
+)
+
+// A TokenValidator checks a bearer token or API key, and returns the
+// Principal it identifies. ValidateToken should return an error wrapping
+// ErrInvalidToken or ErrInsufficientScope if the token is not accepted. Any
+// other error is treated as a server error.
+type TokenValidator interface {
+	ValidateToken(ctx context.Context, token string) (*Principal, error)
+}
+
+// The TokenValidatorFunc type is an adapter to allow the use of ordinary
+// functions as TokenValidators.
+type TokenValidatorFunc func(ctx context.Context, token string) (*Principal, error)
+
+// ValidateToken calls f(ctx, token).
+func (f TokenValidatorFunc) ValidateToken(ctx context.Context, token string) (*Principal, error) {
+	return f(ctx, token)
+}
+
+// StaticTokens returns a TokenValidator that accepts the tokens in tokens,
+// which maps each token to the name of the user it identifies. Tokens are
+// compared in constant time, and every token is checked on every request, so
+// response times don't reveal which tokens exist.
+func StaticTokens(tokens map[string]string) TokenValidator {
+	type entry struct {
+		hash [sha256.Size]byte
+		user string
+	}
+	entries := make([]entry, 0, len(tokens))
+	for token, user := range tokens {
+		entries = append(entries, entry{sha256.Sum256([]byte(token)), user})
+	}
+	return TokenValidatorFunc(func(ctx context.Context, token string) (*Principal, error) {
+		// Hash the token first, since ConstantTimeCompare returns early
+		// for inputs with different lengths.
+		hash := sha256.Sum256([]byte(token))
+		var user string
+		found := false
+		for _, e := range entries {
+			if subtle.ConstantTimeCompare(hash[:], e.hash[:]) == 1 {
+				user, found = e.user, true
+			}
+		}
+		if !found {
+			return nil, ErrInvalidToken
+		}
+		return &Principal{Username: user}, nil
+	})
+}
+
+// TokenAuth protects all requests to the given handler, unless the request
+// has a token accepted by v, either in an "Authorization: Bearer <token>"
+// header or an X-Api-Key header. The Principal returned by v is available to
+// h via GetUser; if its AuthMethod is empty, it is set to AuthMethodBearer or
+// AuthMethodAPIKey.
+//
+// Rejected requests get an error response with a WWW-Authenticate header as
+// described in RFC 6750: 401 if the request has no token or the token is
+// invalid, 400 if the request is malformed, and 403 if v returns
+// ErrInsufficientScope.
+func TokenAuth(h http.Handler, realm string, v TokenValidator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, method, ok := tokenFromRequest(r)
+		if !ok {
+			bearerError(w, r, realm, "invalid_request", "Provide a single bearer token or API key")
+			return
+		}
+		if token == "" {
+			bearerError(w, r, realm, "", "")
+			return
+		}
+		p, err := v.ValidateToken(r.Context(), token)
+		switch {
+		case err == nil && p != nil:
+			p2 := *p
+			if p2.AuthMethod == "" {
+				p2.AuthMethod = method
+			}
+			h.ServeHTTP(w, SetUser(r, &p2))
+		case err == nil, errors.Is(err, ErrInvalidToken):
+			bearerError(w, r, realm, "invalid_token", "The access token is invalid or has expired")
+		case errors.Is(err, ErrInsufficientScope):
+			bearerError(w, r, realm, "insufficient_scope", "The access token does not grant access to this resource")
+		default:
+			rest.ServerError(w, r, err)
+		}
+	})
+}
+
+// tokenFromRequest returns the bearer token or API key sent with r, and the
+// AuthMethod it was sent with. It returns false if r is malformed, for
+// example if it has an empty bearer token, or more than one token.
+func tokenFromRequest(r *http.Request) (token, method string, ok bool) {
+	var tokens []string
+	for _, auth := range r.Header.Values("Authorization") {
+		scheme, value, _ := strings.Cut(auth, " ")
+		if !strings.EqualFold(scheme, "Bearer") {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if value == "" {
+			return "", "", false
+		}
+		tokens = append(tokens, value)
+		method = AuthMethodBearer
+	}
+	for _, key := range r.Header.Values("X-Api-Key") {
+		if key = strings.TrimSpace(key); key == "" {
+			return "", "", false
+		}
+		tokens = append(tokens, key)
+		method = AuthMethodAPIKey
+	}
+	switch len(tokens) {
+	case 0:
+		return "", "", true
+	case 1:
+		return tokens[0], method, true
+	default:
+		return "", "", false
+	}
+}
+
+// bearerError writes an error response with a Bearer WWW-Authenticate
+// challenge, as described in RFC 6750 section 3. If code is empty, the
+// request had no credentials, and the challenge has no error attributes.
+func bearerError(w http.ResponseWriter, r *http.Request, realm, code, description string) {
+	challenge := "Bearer realm=" + quoteAuthParam(realm)
+	if code != "" {
+		challenge += ", error=" + quoteAuthParam(code) + ", error_description=" + quoteAuthParam(description)
+	}
+	switch code {
+	case "invalid_request":
+		w.Header().Set("WWW-Authenticate", challenge)
+		rest.BadRequest(w, r, &resterror.Error{
+			Title:    description,
+			ID:       code,
+			Instance: r.URL.Path,
+		})
+	case "insufficient_scope":
+		w.Header().Set("WWW-Authenticate", challenge)
+		rest.Forbidden(w, r, &resterror.Error{
+			Title:    description,
+			ID:       code,
+			Instance: r.URL.Path,
+		})
+	default:
+		// rest.Unauthorized sets a Basic challenge; replace it.
+		rest.Unauthorized(&challengeWriter{ResponseWriter: w, challenge: challenge}, r, realm)
+	}
+}
+
+// challengeWriter sets the WWW-Authenticate header on 401 responses.
+type challengeWriter struct {
+	http.ResponseWriter
+	challenge   string
+	wroteHeader bool
+}
+
+func (c *challengeWriter) WriteHeader(code int) {
+	if !c.wroteHeader && code == http.StatusUnauthorized {
+		c.Header().Set("WWW-Authenticate", c.challenge)
+	}
+	c.wroteHeader = true
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *challengeWriter) Write(b []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// quoteAuthParam returns s as an HTTP quoted-string.
+func quoteAuthParam(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTokenAuth(t *testing.T) {
+	t.Parallel()
+	static := StaticTokens(map[string]string{"s3cret": "deploy-bot", "other": "ci"})
+	v := TokenValidatorFunc(func(ctx context.Context, token string) (*Principal, error) {
+		switch token {
+		case "readonly":
+			return nil, ErrInsufficientScope
+		case "broken":
+			return nil, errors.New("token store is down")
+		}
+		return static.ValidateToken(ctx, token)
+	})
+	var got *Principal
+	h := TokenAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = GetUser(r.Context())
+		w.WriteHeader(http.StatusNoContent)
+	}), "api", v)
+	tests := []struct {
+		name      string
+		header    http.Header
+		code      int
+		challenge string
+		user      string
+		method    string
+	}{
+		{"no token", nil, 401, `Bearer realm="api"`, "", ""},
+		{"basic auth", http.Header{"Authorization": {"Basic Ym9iOnNlY3JldA=="}}, 401, `Bearer realm="api"`, "", ""},
+		{"bearer", http.Header{"Authorization": {"Bearer s3cret"}}, 204, "", "deploy-bot", AuthMethodBearer},
+		{"lowercase scheme", http.Header{"Authorization": {"bearer other"}}, 204, "", "ci", AuthMethodBearer},
+		{"api key", http.Header{"X-Api-Key": {"s3cret"}}, 204, "", "deploy-bot", AuthMethodAPIKey},
+		{"invalid", http.Header{"Authorization": {"Bearer s3cre"}}, 401, `Bearer realm="api", error="invalid_token", error_description="The access token is invalid or has expired"`, "", ""},
+		{"empty bearer", http.Header{"Authorization": {"Bearer "}}, 400, `Bearer realm="api", error="invalid_request", error_description="Provide a single bearer token or API key"`, "", ""},
+		{"two tokens", http.Header{"Authorization": {"Bearer s3cret"}, "X-Api-Key": {"s3cret"}}, 400, `Bearer realm="api", error="invalid_request", error_description="Provide a single bearer token or API key"`, "", ""},
+		{"scope", http.Header{"X-Api-Key": {"readonly"}}, 403, `Bearer realm="api", error="insufficient_scope", error_description="The access token does not grant access to this resource"`, "", ""},
+		{"server error", http.Header{"X-Api-Key": {"broken"}}, 500, "", "", ""},
+	}
+	for _, tt := range tests {
+		got = nil
+		req := httptest.NewRequest("GET", "/", nil)
+		for k, v := range tt.header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%s: got code %d, want %d", tt.name, w.Code, tt.code)
+		}
+		if hdr := w.Header().Get("WWW-Authenticate"); hdr != tt.challenge {
+			t.Errorf("%s: got WWW-Authenticate %q, want %q", tt.name, hdr, tt.challenge)
+		}
+		if tt.user == "" {
+			if got != nil {
+				t.Errorf("%s: handler called with %+v", tt.name, got)
+			}
+			continue
+		}
+		if got == nil || got.Username != tt.user || got.AuthMethod != tt.method {
+			t.Errorf("%s: got principal %+v, want %s/%s", tt.name, got, tt.user, tt.method)
+		}
+	}
+}
+
+func TestQuoteAuthParam(t *testing.T) {
+	t.Parallel()
+	if got := quoteAuthParam(`my "api" \ realm`); got != `"my \"api\" \\ realm"` {
+		t.Errorf("got %s", got)
+	}
+}
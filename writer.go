@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+)
+
+// wrappedWriter is implemented by every http.ResponseWriter wrapper in this
+// package. Wrappers implement all of the optional interfaces, and wrapWriter
+// hides the ones that the underlying ResponseWriter does not support, so
+// callers can keep using type assertions like w.(http.Hijacker) to detect
+// support.
+type wrappedWriter interface {
+	http.ResponseWriter
+	http.Flusher
+	http.Hijacker
+	http.Pusher
+	io.ReaderFrom
+	// Unwrap returns the underlying ResponseWriter, for use by
+	// http.ResponseController.
+	Unwrap() http.ResponseWriter
+}
+
+// Every ResponseWriter wrapper in this package must implement wrappedWriter,
+// so that http.ResponseController can reach the underlying connection.
+var (
+	_ wrappedWriter = (*serverWriter)(nil)
+	_ wrappedWriter = (*startWriter)(nil)
+	_ wrappedWriter = (*responseLogger)(nil)
+	_ wrappedWriter = (*compressResponseWriter)(nil)
+	_ wrappedWriter = (*debugWriter)(nil)
+)
+
+// baseWriter implements the optional interfaces in wrappedWriter by
+// forwarding them to the underlying ResponseWriter. Wrappers should embed it
+// and implement Write, WriteHeader and ReadFrom themselves, since a ReadFrom
+// on baseWriter would bypass the wrapper's Write method.
+type baseWriter struct {
+	w http.ResponseWriter
+}
+
+func (b *baseWriter) Header() http.Header {
+	return b.w.Header()
+}
+
+// Flush implements the http.Flusher interface.
+func (b *baseWriter) Flush() {
+	if f, ok := b.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements the http.Hijacker interface.
+func (b *baseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := b.w.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+// Push implements the http.Pusher interface.
+func (b *baseWriter) Push(target string, opts *http.PushOptions) error {
+	return push(b.w, target, opts)
+}
+
+// Unwrap returns the underlying ResponseWriter.
+func (b *baseWriter) Unwrap() http.ResponseWriter {
+	return b.w
+}
+
+// readFrom copies r to the underlying writer using its ReadFrom method if it
+// has one (for example, to use sendfile), or to w otherwise.
+func readFrom(under http.ResponseWriter, w io.Writer, r io.Reader) (int64, error) {
+	if rf, ok := under.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(writerOnly{w}, r)
+}
+
+// writerOnly hides any ReadFrom method on the embedded Writer, so io.Copy
+// does not call back into it.
+type writerOnly struct {
+	io.Writer
+}
+
+type unwrapper interface {
+	http.ResponseWriter
+	Unwrap() http.ResponseWriter
+}
+
+// wrapWriter returns a ResponseWriter that calls methods on ww, but only
+// implements the optional interfaces (http.Flusher, http.Hijacker,
+// http.Pusher and io.ReaderFrom) that are implemented by w, the
+// ResponseWriter ww wraps.
+func wrapWriter(w http.ResponseWriter, ww wrappedWriter) http.ResponseWriter {
+	var flags int
+	if _, ok := w.(http.Flusher); ok {
+		flags |= 1
+	}
+	if _, ok := w.(http.Hijacker); ok {
+		flags |= 2
+	}
+	if _, ok := w.(http.Pusher); ok {
+		flags |= 4
+	}
+	if _, ok := w.(io.ReaderFrom); ok {
+		flags |= 8
+	}
+	switch flags {
+	case 0:
+		return struct {
+			unwrapper
+		}{ww}
+	case 1:
+		return struct {
+			unwrapper
+			http.Flusher
+		}{ww, ww}
+	case 2:
+		return struct {
+			unwrapper
+			http.Hijacker
+		}{ww, ww}
+	case 3:
+		return struct {
+			unwrapper
+			http.Flusher
+			http.Hijacker
+		}{ww, ww, ww}
+	case 4:
+		return struct {
+			unwrapper
+			http.Pusher
+		}{ww, ww}
+	case 5:
+		return struct {
+			unwrapper
+			http.Flusher
+			http.Pusher
+		}{ww, ww, ww}
+	case 6:
+		return struct {
+			unwrapper
+			http.Hijacker
+			http.Pusher
+		}{ww, ww, ww}
+	case 7:
+		return struct {
+			unwrapper
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{ww, ww, ww, ww}
+	case 8:
+		return struct {
+			unwrapper
+			io.ReaderFrom
+		}{ww, ww}
+	case 9:
+		return struct {
+			unwrapper
+			http.Flusher
+			io.ReaderFrom
+		}{ww, ww, ww}
+	case 10:
+		return struct {
+			unwrapper
+			http.Hijacker
+			io.ReaderFrom
+		}{ww, ww, ww}
+	case 11:
+		return struct {
+			unwrapper
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{ww, ww, ww, ww}
+	case 12:
+		return struct {
+			unwrapper
+			http.Pusher
+			io.ReaderFrom
+		}{ww, ww, ww}
+	case 13:
+		return struct {
+			unwrapper
+			http.Flusher
+			http.Pusher
+			io.ReaderFrom
+		}{ww, ww, ww, ww}
+	case 14:
+		return struct {
+			unwrapper
+			http.Hijacker
+			http.Pusher
+			io.ReaderFrom
+		}{ww, ww, ww, ww}
+	default:
+		return struct {
+			unwrapper
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+			io.ReaderFrom
+		}{ww, ww, ww, ww, ww}
+	}
+}
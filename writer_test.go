@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type pusherWriter struct {
+	*httptest.ResponseRecorder
+	pushed []string
+}
+
+func (p *pusherWriter) Push(target string, opts *http.PushOptions) error {
+	p.pushed = append(p.pushed, target)
+	return nil
+}
+
+func TestWrapWriterPreservesInterfaces(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		w        http.ResponseWriter
+		flusher  bool
+		hijacker bool
+		pusher   bool
+	}{
+		{"recorder", httptest.NewRecorder(), true, false, false},
+		{"full", fullyFeaturedResponseWriter{}, true, true, false},
+		{"pusher", &pusherWriter{ResponseRecorder: httptest.NewRecorder()}, true, false, true},
+	}
+	middlewares := map[string]func(http.Handler) http.Handler{
+		"Server":   func(h http.Handler) http.Handler { return Server(h, "test") },
+		"Duration": Duration,
+		"Log":      Log,
+		"GZip":     GZip,
+		"All":      func(h http.Handler) http.Handler { return All(h, "test") },
+	}
+	for _, tt := range tests {
+		for name, mw := range middlewares {
+			h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if _, ok := w.(http.Flusher); ok != tt.flusher {
+					t.Errorf("%s/%s: Flusher: got %t, want %t", tt.name, name, ok, tt.flusher)
+				}
+				if _, ok := w.(http.Hijacker); ok != tt.hijacker {
+					t.Errorf("%s/%s: Hijacker: got %t, want %t", tt.name, name, ok, tt.hijacker)
+				}
+				if _, ok := w.(http.Pusher); ok != tt.pusher {
+					t.Errorf("%s/%s: Pusher: got %t, want %t", tt.name, name, ok, tt.pusher)
+				}
+				if _, ok := w.(interface{ Unwrap() http.ResponseWriter }); !ok {
+					t.Errorf("%s/%s: missing Unwrap method", tt.name, name)
+				}
+			}))
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			h.ServeHTTP(tt.w, req)
+		}
+	}
+}
+
+func TestHijackThroughAll(t *testing.T) {
+	t.Parallel()
+	h := All(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			t.Error("ResponseWriter does not implement http.Hijacker")
+			return
+		}
+		conn, bufrw, err := hj.Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		bufrw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: test\r\nConnection: Upgrade\r\n\r\nhijacked")
+		bufrw.Flush()
+	}), "test")
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "test")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hijacked" {
+		t.Errorf("wrong body, got %q", body)
+	}
+}
+
+func TestReadFromCountsBytes(t *testing.T) {
+	t.Parallel()
+	w := httptest.NewRecorder()
+	logger := &responseLogger{baseWriter: baseWriter{w: w}}
+	n, err := logger.ReadFrom(strings.NewReader("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 11 || logger.Size() != 11 {
+		t.Errorf("expected 11 bytes, got %d (size %d)", n, logger.Size())
+	}
+	if logger.Status() != 200 {
+		t.Errorf("expected status 200, got %d", logger.Status())
+	}
+	if w.Body.String() != "hello world" {
+		t.Errorf("wrong body: %q", w.Body.String())
+	}
+}
+
+func TestResponseControllerThroughAll(t *testing.T) {
+	t.Parallel()
+	errs := make(chan error, 5)
+	h := All(GZip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		deadline := time.Now().Add(5 * time.Second)
+		if err := rc.SetReadDeadline(deadline); err != nil {
+			errs <- fmt.Errorf("SetReadDeadline: %w", err)
+		}
+		if err := rc.SetWriteDeadline(deadline); err != nil {
+			errs <- fmt.Errorf("SetWriteDeadline: %w", err)
+		}
+		if err := rc.EnableFullDuplex(); err != nil {
+			errs <- fmt.Errorf("EnableFullDuplex: %w", err)
+		}
+		io.WriteString(w, "flushed")
+		if err := rc.Flush(); err != nil {
+			errs <- fmt.Errorf("Flush: %w", err)
+		}
+		close(errs)
+	})), "test")
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "flushed" {
+		t.Errorf("wrong body, got %q", body)
+	}
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestResponseControllerHijackThroughAll(t *testing.T) {
+	t.Parallel()
+	h := All(GZip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, bufrw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		bufrw.WriteString("HTTP/1.1 204 No Content\r\n\r\n")
+		bufrw.Flush()
+	})), "test")
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", resp.StatusCode)
+	}
+}